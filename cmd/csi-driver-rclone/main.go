@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -11,7 +13,14 @@ import (
 
 	"github.com/cornfeedhobo/csi-driver-rclone/internal/csirclone"
 	"github.com/cornfeedhobo/csi-driver-rclone/internal/kclient"
+	_ "github.com/rclone/rclone/backend/all" // import all backends, for the embedded mode
+	_ "github.com/rclone/rclone/cmd/all"     // import all commands, registering mount types
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/configfile"
+	_ "github.com/rclone/rclone/lib/plugin" // import plugins
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 )
 
@@ -29,10 +38,18 @@ var (
 
 	secretName string
 
+	rcloneConfigPath string
+
 	cmd = &cobra.Command{
 		Use: csirclone.DefaultDriverName,
 		Run: run,
 	}
+
+	stateCmd = &cobra.Command{
+		Use:   "state",
+		Short: "print the mounts recorded in the state dir, for debugging",
+		Run:   printState,
+	}
 )
 
 func init() {
@@ -48,12 +65,22 @@ func init() {
 
 	cmd.Flags().StringVar(&secretName, "secret-name", "", "name of the secret containing config for rclone.")
 
-	cmd.Flags().StringVar(&driverOpt.Address, "rcd-address", "http://localhost:5572/", "the address to use when contacting rcd.")
+	cmd.Flags().StringVar(&driverOpt.RcdMode, "rcd-mode", csirclone.RcdModeSidecar, "how to reach rclone: 'sidecar' calls rcd at rcd-address, 'embedded' runs rclone in the driver process.")
+
+	cmd.Flags().StringVar(&rcloneConfigPath, "rclone-config-path", "", "path of the rclone config file used in embedded mode. defaults to the rclone default.")
+
+	cmd.Flags().StringVar(&driverOpt.Address, "rcd-address", "http://localhost:5572/", "the address to use when contacting rcd, e.g. http://localhost:5572/ or unix:///run/rclone/rc.sock.")
 
 	cmd.Flags().StringVar(&driverOpt.Username, "rcd-username", "", "the username to use when contacting rcd. required if secretname is not set.")
 
 	cmd.Flags().StringVar(&driverOpt.Password, "rcd-password", "", "the password to use when contacting rcd. required if secretname is not set.")
 
+	cmd.Flags().IntVar(&driverOpt.RCRetries, "rcd-retries", csirclone.DefaultRCRetries, "how many times to retry rcd calls failing temporarily, e.g. while rcd restarts.")
+
+	cmd.Flags().DurationVar(&driverOpt.RCRetryBackoff, "rcd-retry-backoff", csirclone.DefaultRCRetryBackoff, "delay before the first retry of an rcd call, doubled on every retry.")
+
+	cmd.Flags().DurationVar(&driverOpt.RCTimeout, "rcd-timeout", csirclone.DefaultRCTimeout, "timeout of each attempt of an rcd call, except copies, sizes, purges and unmounts. disabled if zero.")
+
 	cmd.Flags().StringVar(&driverOpt.Remote, "remote", "", "rclone remote to use. required if secretname is not set.")
 
 	cmd.Flags().StringVar(&driverOpt.MountType, "mounttype", csirclone.DefaultMountType, "rclone mount type.")
@@ -61,6 +88,53 @@ func init() {
 	cmd.Flags().StringToStringVar(&driverOpt.MountOpt, "mountopt", defaultMountOpt, "rclone mount options.")
 
 	cmd.Flags().StringToStringVar(&driverOpt.VfsOpt, "vfsopt", defaultVfsOpt, "rclone vfs options.")
+
+	cmd.Flags().StringSliceVar(&driverOpt.OptOverrideAllow, "opt-override-allow", nil, "mount type, mount and vfs options volumes may override, e.g. 'mountType', 'vfsOpt.CacheMode' or 'mountOpt.*'. all if empty.")
+
+	cmd.Flags().StringSliceVar(&driverOpt.OptOverrideDeny, "opt-override-deny", nil, "mount type, mount and vfs options volumes may not override, e.g. 'mountType' or 'mountOpt.AllowOther'.")
+
+	cmd.Flags().StringSliceVar(&driverOpt.InlineAllow, "inline-allow", nil, "remotes inline volumes may mount, with their sub-paths, e.g. 'datasets:' or 's3:bucket/public'. inline volumes are refused if empty.")
+
+	cmd.Flags().BoolVar(&driverOpt.InlineWritable, "inline-writable", false, "allow inline volumes to be mounted read-write. they are read-only otherwise.")
+
+	cmd.Flags().StringVar(&driverOpt.StateDir, "state-dir", "", "node-local directory to record mounts in, so they can be restored when rcd restarts. disabled if empty.")
+
+	cmd.Flags().DurationVar(&driverOpt.ReconcileInterval, "reconcile-interval", csirclone.DefaultReconcileInterval, "how often to look for broken mounts to restore.")
+
+	cmd.Flags().StringVar(&driverOpt.QuotaMode, "quota-mode", "", "what to do when a volume grows beyond its capacity: 'warn' emits events, 'readonly' also remounts it read-only, once no pod uses it. requires state-dir. disabled if empty.")
+
+	cmd.Flags().DurationVar(&driverOpt.QuotaInterval, "quota-interval", csirclone.DefaultQuotaInterval, "how often to compute the size of mounted volumes.")
+
+	cmd.Flags().Int64Var(&driverOpt.CapacityFallback, "capacity-fallback", -1, "capacity in bytes to report when the remote does not support about. negative values report an error.")
+
+	cmd.Flags().BoolVar(&driverOpt.CapacitySubtractProvisioned, "capacity-subtract-provisioned", false, "subtract the capacity of provisioned volumes from the reported capacity.")
+
+	stateCmd.Flags().StringVar(&driverOpt.StateDir, "state-dir", "", "node-local directory the mounts are recorded in.")
+	cmd.AddCommand(stateCmd)
+}
+
+func printState(cmd *cobra.Command, args []string) {
+
+	if driverOpt.StateDir == "" {
+		klog.Fatal("state-dir is required")
+	}
+
+	state, err := csirclone.NewStateStore(driverOpt.StateDir)
+	if err != nil {
+		klog.Fatalf("error opening state: %s", err)
+	}
+
+	mounts, err := state.List()
+	if err != nil {
+		klog.Fatalf("error listing state: %s", err)
+	}
+
+	b, err := json.MarshalIndent(mounts, "", "  ")
+	if err != nil {
+		klog.Fatalf("error marshalling state: %s", err)
+	}
+
+	fmt.Println(string(b))
 }
 
 func run(cmd *cobra.Command, args []string) {
@@ -69,11 +143,20 @@ func run(cmd *cobra.Command, args []string) {
 		klog.Warning("node-id is empty")
 	}
 
+	var (
+		client          *kclient.Client
+		resourceVersion string
+	)
+
+	// flag values, used as a base every time the config secret is loaded
+	flagOpt := driverOpt.Clone()
+
 	if secretName != "" {
 
 		klog.Infof("Pulling config from secret '%s'", secretName)
 
-		client, err := kclient.NewClient()
+		var err error
+		client, err = kclient.NewClient()
 		if err != nil {
 			klog.Fatalf("error creating k8s client instance: %s", err)
 		}
@@ -85,16 +168,61 @@ func run(cmd *cobra.Command, args []string) {
 
 		klog.Info("Parsing config secret data")
 
-		// FIXME
-		panic(secret)
+		if err := driverOpt.LoadSecretData(secret.Data); err != nil {
+			klog.Fatalf("error parsing k8s secret '%s': %s", secretName, err)
+		}
+
+		resourceVersion = secret.ResourceVersion
 	}
 
 	if err := driverOpt.Validate(); err != nil {
 		klog.Fatalf("error validating driver options: %s", err)
 	}
 
+	if driverOpt.RcdMode == csirclone.RcdModeEmbedded {
+		if rcloneConfigPath != "" {
+			if err := config.SetConfigPath(rcloneConfigPath); err != nil {
+				klog.Fatalf("error setting rclone config path: %s", err)
+			}
+		}
+		configfile.Install()
+		klog.Infof("Running rclone embedded, with config %s", config.GetConfigPath())
+	}
+
 	driver := csirclone.NewDriver(driverOpt)
 
+	if driverOpt.RcloneConfig != "" {
+		klog.Info("Applying rclone config")
+
+		// rcd usually runs in a sidecar, which may still be starting
+		err := wait.PollUntilContextTimeout(context.Background(), 2*time.Second, time.Minute, true, func(ctx context.Context) (bool, error) {
+			if err := driver.ApplyRcloneConfig(ctx); err != nil {
+				klog.Warningf("error applying rclone config, retrying: %s", err)
+				return false, nil
+			}
+			return true, nil
+		})
+		if err != nil {
+			klog.Fatalf("error applying rclone config: %s", err)
+		}
+	}
+
+	if client != nil {
+		watchSecret(client, driver, flagOpt, resourceVersion)
+	}
+
+	if driverOpt.QuotaMode != "" {
+		if client == nil {
+			var err error
+			if client, err = kclient.NewClient(); err != nil {
+				klog.Warningf("error creating k8s client instance, quota events are only logged: %s", err)
+			}
+		}
+		if client != nil {
+			driver.Events = client.NewEventRecorder(driverOpt.DriverName)
+		}
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -106,6 +234,39 @@ func run(cmd *cobra.Command, args []string) {
 	driver.Wait()
 }
 
+// watchSecret reloads the driver every time the config secret changes.
+// Invalid updates are rejected, keeping the previous config.
+func watchSecret(client *kclient.Client, driver *csirclone.Driver, flagOpt *csirclone.DriverOptions, resourceVersion string) {
+
+	recorder := client.NewEventRecorder(driverOpt.DriverName)
+
+	err := client.WatchSecret(context.Background(), secretName, func(secret *corev1.Secret) {
+
+		// the initial add is usually the secret loaded on startup
+		if secret.ResourceVersion == resourceVersion {
+			return
+		}
+		resourceVersion = secret.ResourceVersion
+
+		opt := flagOpt.Clone()
+		err := opt.LoadSecretData(secret.Data)
+		if err == nil {
+			err = driver.Reload(context.Background(), opt)
+		}
+		if err != nil {
+			klog.Errorf("error reloading config from secret '%s', keeping previous config: %s", secretName, err)
+			recorder.Eventf(secret, corev1.EventTypeWarning, "ConfigReloadFailed", "Error reloading config on node %s: %s", driverOpt.NodeId, err)
+			return
+		}
+
+		klog.Infof("Reloaded config from secret '%s' (resourceVersion %s)", secretName, secret.ResourceVersion)
+		recorder.Eventf(secret, corev1.EventTypeNormal, "ConfigReloaded", "Reloaded config on node %s", driverOpt.NodeId)
+	})
+	if err != nil {
+		klog.Fatalf("error watching k8s secret '%s': %s", secretName, err)
+	}
+}
+
 func main() {
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
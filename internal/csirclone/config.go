@@ -0,0 +1,268 @@
+package csirclone
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/rclone/rclone/fs/rc"
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+// Keys read from the config secret, named after the equivalent flags
+const (
+	ConfigKeyAddress      = "rcd-address"
+	ConfigKeyUsername     = "rcd-username"
+	ConfigKeyPassword     = "rcd-password"
+	ConfigKeyRemote       = "remote"
+	ConfigKeyMountType    = "mounttype"
+	ConfigKeyMountOpt     = "mountopt"
+	ConfigKeyVfsOpt       = "vfsopt"
+	ConfigKeyRcloneConfig = "rclone.conf"
+)
+
+var configKeys = []string{
+	ConfigKeyAddress,
+	ConfigKeyUsername,
+	ConfigKeyPassword,
+	ConfigKeyRemote,
+	ConfigKeyMountType,
+	ConfigKeyMountOpt,
+	ConfigKeyVfsOpt,
+	ConfigKeyRcloneConfig,
+}
+
+// LoadSecretData overrides the options with the values found in the data of a config secret.
+// Mount and vfs options are merged into the current options, key by key,
+// using the same "key=value,key=value" syntax as the flags.
+func (o *DriverOptions) LoadSecretData(data map[string][]byte) error {
+
+	for key := range data {
+		if !isConfigKey(key) {
+			return fmt.Errorf("unknown key '%s', expected one of: %s", key, strings.Join(configKeys, ", "))
+		}
+	}
+
+	for key, target := range map[string]*string{
+		ConfigKeyAddress:      &o.Address,
+		ConfigKeyUsername:     &o.Username,
+		ConfigKeyPassword:     &o.Password,
+		ConfigKeyRemote:       &o.Remote,
+		ConfigKeyMountType:    &o.MountType,
+		ConfigKeyRcloneConfig: &o.RcloneConfig,
+	} {
+		if value, ok := data[key]; ok {
+			*target = strings.TrimSpace(string(value))
+			if *target == "" {
+				return fmt.Errorf("key '%s' is empty", key)
+			}
+		}
+	}
+
+	for key, target := range map[string]*map[string]string{
+		ConfigKeyMountOpt: &o.MountOpt,
+		ConfigKeyVfsOpt:   &o.VfsOpt,
+	} {
+		value, ok := data[key]
+		if !ok {
+			continue
+		}
+		opt, err := parseOptString(string(value))
+		if err != nil {
+			return fmt.Errorf("key '%s' is malformed: %w", key, err)
+		}
+		if *target == nil {
+			*target = make(map[string]string, len(opt))
+		}
+		for k, v := range opt {
+			(*target)[k] = v
+		}
+	}
+
+	if o.RcloneConfig != "" {
+		if _, err := parseRcloneConfig(o.RcloneConfig); err != nil {
+			return fmt.Errorf("key '%s' is malformed: %w", ConfigKeyRcloneConfig, err)
+		}
+	}
+
+	return nil
+}
+
+func isConfigKey(key string) bool {
+	for _, k := range configKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOptString parses options in the "key=value,key=value" syntax of the flags
+func parseOptString(s string) (map[string]string, error) {
+
+	opt := map[string]string{}
+
+	for _, pair := range strings.Split(strings.TrimSpace(s), ",") {
+		if pair == "" {
+			continue
+		}
+		k, v, found := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !found || k == "" {
+			return nil, fmt.Errorf("expected key=value, got '%s'", pair)
+		}
+		opt[k] = strings.TrimSpace(v)
+	}
+
+	return opt, nil
+}
+
+// parseRcloneConfig returns the parameters of each remote of an rclone config file
+func parseRcloneConfig(conf string) (map[string]map[string]string, error) {
+
+	c, err := goconfig.LoadFromReader(strings.NewReader(conf))
+	if err != nil {
+		return nil, err
+	}
+
+	remotes := map[string]map[string]string{}
+
+	for _, name := range c.GetSectionList() {
+		section, err := c.GetSection(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(section) == 0 && name == goconfig.DEFAULT_SECTION {
+			continue
+		}
+		if section["type"] == "" {
+			return nil, fmt.Errorf("remote '%s' is missing type", name)
+		}
+		remotes[name] = section
+	}
+
+	return remotes, nil
+}
+
+// ApplyRcloneConfig creates the remotes of RcloneConfig with rcd.
+// Values are passed as is, so passwords must already be obscured, as in any rclone config file.
+func (d *Driver) ApplyRcloneConfig(ctx context.Context) error {
+
+	d.config.RLock()
+	conf := d.RcloneConfig
+	d.config.RUnlock()
+
+	if conf == "" {
+		return nil
+	}
+
+	remotes, err := parseRcloneConfig(conf)
+	if err != nil {
+		return fmt.Errorf("error parsing rclone config: %w", err)
+	}
+
+	names := make([]string, 0, len(remotes))
+	for name := range remotes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		parameters := remotes[name]
+		remoteType := parameters["type"]
+		delete(parameters, "type")
+
+		klog.Infof("Creating remote '%s' of type '%s'", name, remoteType)
+
+		_, err := d.RC(ctx, "config/create", rc.Params{
+			"name":       name,
+			"type":       remoteType,
+			"parameters": parameters,
+			"opt": rc.Params{
+				"noObscure":      true,
+				"nonInteractive": true,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error creating remote '%s': %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Clone returns a copy of the options that shares no maps with the original.
+func (o *DriverOptions) Clone() *DriverOptions {
+
+	c := *o
+
+	for _, opt := range []*map[string]string{&c.MountOpt, &c.VfsOpt} {
+		if *opt == nil {
+			continue
+		}
+		m := make(map[string]string, len(*opt))
+		for k, v := range *opt {
+			m[k] = v
+		}
+		*opt = m
+	}
+
+	c.OptOverrideAllow = slices.Clone(c.OptOverrideAllow)
+	c.OptOverrideDeny = slices.Clone(c.OptOverrideDeny)
+	c.InlineAllow = slices.Clone(c.InlineAllow)
+
+	return &c
+}
+
+// Reload swaps the reloadable options of the running driver with those of opts:
+// the rcd credentials, the mount and vfs options, and the rclone config, whose remotes are created with rcd.
+// Nothing is changed when opts are invalid, or when the rclone config can't be applied.
+// Changes to the rcd address, the default remote and the mount type are refused, since they require a restart:
+// the ids of the volumes on the default remote don't include it, and would point to another storage.
+func (d *Driver) Reload(ctx context.Context, opts *DriverOptions) error {
+
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if _, err := d.marshalOpt(ctx, OptBlockMount, opts.MountOpt); err != nil {
+		return err
+	}
+	if _, err := d.marshalOpt(ctx, OptBlockVfs, opts.VfsOpt); err != nil {
+		return err
+	}
+
+	if opts.Address != d.Address || opts.Remote != d.DefaultRemote() || opts.MountType != d.MountType {
+		return fmt.Errorf("changes to %s, %s and %s require a restart", ConfigKeyAddress, ConfigKeyRemote, ConfigKeyMountType)
+	}
+
+	opts = opts.Clone()
+
+	d.config.Lock()
+	previous := d.DriverOptions.Clone()
+	d.setReloadable(opts)
+	d.config.Unlock()
+
+	if opts.RcloneConfig != previous.RcloneConfig {
+		if err := d.ApplyRcloneConfig(ctx); err != nil {
+			d.config.Lock()
+			d.setReloadable(previous)
+			d.config.Unlock()
+			return fmt.Errorf("error applying rclone config: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// setReloadable sets the options changed by Reload, with the config lock held
+func (d *Driver) setReloadable(opts *DriverOptions) {
+	d.Username = opts.Username
+	d.Password = opts.Password
+	d.MountOpt = opts.MountOpt
+	d.VfsOpt = opts.VfsOpt
+	d.RcloneConfig = opts.RcloneConfig
+}
@@ -2,12 +2,16 @@ package csirclone
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/cornfeedhobo/csi-driver-rclone/internal/csicommon"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"k8s.io/klog/v2"
 )
 
@@ -31,6 +35,13 @@ func NewControlServer(d *Driver) *ControlServer {
 	cs.SetCapabilities([]csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 	})
 
 	return cs
@@ -55,6 +66,8 @@ func (cs *ControlServer) SetCapabilities(caps []csi.ControllerServiceCapability_
 // ControllerExpandVolume
 func (cs *ControlServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
 	id := req.GetVolumeId()
 	if id == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -62,7 +75,7 @@ func (cs *ControlServer) ControllerExpandVolume(ctx context.Context, req *csi.Co
 
 	exist, err := cs.driver.IsVolume(ctx, id)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 	if !exist {
 		return nil, status.Error(codes.NotFound, "specified volume does not exist")
@@ -77,7 +90,7 @@ func (cs *ControlServer) ControllerExpandVolume(ctx context.Context, req *csi.Co
 		if errors.Is(err, ErrNotFound) {
 			return nil, status.Error(codes.NotFound, "specified volume does not exist")
 		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	return &csi.ControllerExpandVolumeResponse{
@@ -95,17 +108,55 @@ func (cs *ControlServer) ControllerGetCapabilities(ctx context.Context, req *csi
 // CreateVolume
 func (cs *ControlServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
 	name := req.GetName()
 	if name == "" {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
 	klog.V(2).Infof("CreateVolume: name: %s", name)
 
-	err := cs.validateVolumeCapabilities(req.GetVolumeCapabilities())
+	err := cs.validateVolumeCapabilities(req.GetVolumeCapabilities(), req.GetParameters())
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	if err := cs.driver.ValidateVolumeOpt(ctx, req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var sourceSnapshot *Snapshot
+	var sourceVolume *Volume
+	var sourceSize int64
+
+	source := req.GetVolumeContentSource()
+	switch {
+	case source.GetSnapshot() != nil:
+		id := source.GetSnapshot().GetSnapshotId()
+		sourceSnapshot, err = cs.driver.ReadSnapshot(ctx, id)
+		if err != nil {
+			return nil, statusFromError(fmt.Errorf("CreateVolume: %w", err))
+		}
+		if sourceSnapshot == nil {
+			return nil, status.Errorf(codes.NotFound, "Snapshot with ID '%s' does not exist", id)
+		}
+		sourceSize = sourceSnapshot.Size
+	case source.GetVolume() != nil:
+		id := source.GetVolume().GetVolumeId()
+		sourceVolume, err = cs.driver.ReadVolume(ctx, id)
+		if err != nil {
+			return nil, statusFromError(fmt.Errorf("CreateVolume: %w", err))
+		}
+		if sourceVolume == nil {
+			return nil, status.Errorf(codes.NotFound, "Volume with ID '%s' does not exist", id)
+		}
+		sourceSize = sourceVolume.Capacity
+	}
+
+	if required := req.GetCapacityRange().GetRequiredBytes(); required > 0 && required < sourceSize {
+		return nil, status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than source size %d", required, sourceSize)
+	}
+
 	parameters := req.GetParameters()
 	if parameters == nil {
 		parameters = make(map[string]string)
@@ -113,35 +164,43 @@ func (cs *ControlServer) CreateVolume(ctx context.Context, req *csi.CreateVolume
 	klog.V(2).Infof("CreateVolume: parameters: %v", parameters)
 
 	newVolume := NewVolume(
-		cs.driver.Remote,
+		cs.driver.RemoteFromParameters(parameters),
 		name,
-		req.CapacityRange.RequiredBytes,
+		req.GetCapacityRange().GetRequiredBytes(),
 	)
+	newVolumeID := cs.driver.VolumeID(newVolume)
 
-	klog.V(2).Infof("CreateVolume: checking if volume '%s' already exists", newVolume.ID)
+	// record the options overridden by the volume, already validated
+	newVolume.MountOpt, _ = VolumeOpt(parameters, ParameterMountOpt)
+	newVolume.VfsOpt, _ = VolumeOpt(parameters, ParameterVfsOpt)
 
-	curVolume, err := cs.driver.ReadVolume(ctx, newVolume.ID)
+	if !cs.driver.Locks.TryAcquire(newVolumeID) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, newVolumeID)
+	}
+	defer cs.driver.Locks.Release(newVolumeID)
+
+	klog.V(2).Infof("CreateVolume: checking if volume '%s' already exists", newVolumeID)
+
+	curVolume, err := cs.driver.ReadVolume(ctx, newVolumeID)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "CreateVolume: %s", err)
+		if errors.Is(err, ErrRemoteNotFound) {
+			return nil, status.Errorf(codes.InvalidArgument, "remote '%s' is not configured", newVolume.Remote)
+		}
+		return nil, statusFromError(fmt.Errorf("CreateVolume: %w", err))
 	}
 
 	if curVolume != nil {
 		klog.V(2).Infof("CreateVolume: volume already exists, validating metadata")
 
-		err = curVolume.IsConflict(newVolume)
-		if err != nil {
-			// special case, required to pass csi-sanity
-			if errors.Is(err, ErrMetaWrongCapacity) {
-				return nil, status.Error(codes.AlreadyExists, err.Error())
-			}
-			return nil, err // FIXMEs
+		if err := curVolume.IsConflict(newVolume); err != nil {
+			return nil, statusFromError(err)
 		}
 
 		klog.V(2).Infof("CreateVolume: volume already exists and is healthy")
 
 		return &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
-				VolumeId:      curVolume.ID,
+				VolumeId:      cs.driver.VolumeID(curVolume),
 				CapacityBytes: curVolume.Capacity,
 				VolumeContext: parameters,
 				ContentSource: req.GetVolumeContentSource(),
@@ -151,14 +210,32 @@ func (cs *ControlServer) CreateVolume(ctx context.Context, req *csi.CreateVolume
 
 	klog.V(2).Info("CreateVolume: volume does not exist, creating")
 
+	// record the remote first, so its volumes are listed once created
+	if err := cs.driver.RegisterRemote(ctx, newVolume.Remote); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	// populate the volume before writing metadata, so it is only visible once complete
+	switch {
+	case sourceSnapshot != nil:
+		klog.V(2).Infof("CreateVolume: restoring snapshot '%s'", sourceSnapshot.ID)
+		err = cs.driver.RestoreSnapshot(ctx, newVolume, sourceSnapshot)
+	case sourceVolume != nil:
+		klog.V(2).Infof("CreateVolume: cloning volume '%s'", sourceVolume.ID)
+		err = cs.driver.CloneVolume(ctx, newVolume, sourceVolume)
+	}
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+
 	err = cs.driver.WriteVolume(ctx, newVolume)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      newVolume.ID,
+			VolumeId:      newVolumeID,
 			CapacityBytes: 0, // by setting it to zero, Provisioner will use PVC requested size as PV size
 			VolumeContext: parameters,
 			ContentSource: req.GetVolumeContentSource(),
@@ -166,9 +243,182 @@ func (cs *ControlServer) CreateVolume(ctx context.Context, req *csi.CreateVolume
 	}, nil
 }
 
+// CreateSnapshot
+func (cs *ControlServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	klog.V(2).Infof("CreateSnapshot: name: %s", name)
+
+	sourceID := req.GetSourceVolumeId()
+	if sourceID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Source Volume ID missing in request")
+	}
+
+	source, err := cs.driver.ReadVolume(ctx, sourceID)
+	if err != nil {
+		return nil, statusFromError(fmt.Errorf("CreateSnapshot: %w", err))
+	}
+	if source == nil {
+		return nil, status.Errorf(codes.NotFound, "Volume with ID '%s' does not exist", sourceID)
+	}
+
+	// snapshots are kept on the remote of their source, allowing server-side copies
+	newSnapshot := NewSnapshot(
+		source.Remote,
+		name,
+		sourceID,
+		source.Capacity,
+	)
+	newSnapshotID := cs.driver.SnapshotID(newSnapshot)
+
+	if !cs.driver.Locks.TryAcquire(newSnapshotID) {
+		return nil, status.Errorf(codes.Aborted, snapshotOperationAlreadyExistsFmt, newSnapshotID)
+	}
+	defer cs.driver.Locks.Release(newSnapshotID)
+
+	klog.V(2).Infof("CreateSnapshot: checking if snapshot '%s' already exists", newSnapshotID)
+
+	curSnapshot, err := cs.driver.ReadSnapshot(ctx, newSnapshotID)
+	if err != nil {
+		return nil, statusFromError(fmt.Errorf("CreateSnapshot: %w", err))
+	}
+
+	if curSnapshot != nil {
+		klog.V(2).Infof("CreateSnapshot: snapshot already exists, validating metadata")
+
+		if err := curSnapshot.IsConflict(newSnapshot); err != nil {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+
+		klog.V(2).Infof("CreateSnapshot: snapshot already exists and is healthy")
+
+		return &csi.CreateSnapshotResponse{
+			Snapshot: cs.newCSISnapshot(curSnapshot),
+		}, nil
+	}
+
+	klog.V(2).Info("CreateSnapshot: snapshot does not exist, copying source volume")
+
+	if err := cs.driver.CreateSnapshot(ctx, newSnapshot, source); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: cs.newCSISnapshot(newSnapshot),
+	}, nil
+}
+
+// DeleteSnapshot
+func (cs *ControlServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
+	id := req.GetSnapshotId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+
+	if !cs.driver.Locks.TryAcquire(id) {
+		return nil, status.Errorf(codes.Aborted, snapshotOperationAlreadyExistsFmt, id)
+	}
+	defer cs.driver.Locks.Release(id)
+
+	snapshot, err := cs.driver.ReadSnapshot(ctx, id)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	if snapshot != nil {
+		if err := cs.driver.PurgeSnapshot(ctx, id); err != nil {
+			return nil, statusFromError(err)
+		}
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// GetCapacity
+func (cs *ControlServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+
+	if caps := req.GetVolumeCapabilities(); len(caps) > 0 {
+		if err := cs.validateVolumeCapabilities(caps, req.GetParameters()); err != nil {
+			// no capacity is available for unsupported capabilities
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+
+	available, err := cs.driver.AvailableCapacity(ctx, cs.driver.RemoteFromParameters(req.GetParameters()))
+	if err != nil {
+		if errors.Is(err, ErrAboutNotSupported) {
+			return nil, status.Errorf(codes.FailedPrecondition, "%s: configure a capacity fallback to report capacity for this remote", err)
+		}
+		return nil, statusFromError(err)
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+		MaximumVolumeSize: &wrappers.Int64Value{Value: available},
+	}, nil
+}
+
+// ListSnapshots
+func (cs *ControlServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
+	// only the remote identified by the request is listed, every remote holding volumes otherwise
+	var snapshots []*Snapshot
+	var err error
+	switch {
+	case req.GetSnapshotId() != "":
+		remote, _ := cs.driver.splitID(req.GetSnapshotId())
+		snapshots, err = cs.driver.ListSnapshots(ctx, remote)
+	case req.GetSourceVolumeId() != "":
+		remote, _ := cs.driver.splitID(req.GetSourceVolumeId())
+		snapshots, err = cs.driver.ListSnapshots(ctx, remote)
+	default:
+		snapshots, err = cs.driver.ListAllSnapshots(ctx)
+	}
+	if err != nil {
+		if errors.Is(err, ErrRemoteNotFound) {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		return nil, statusFromError(err)
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, s := range snapshots {
+		if id := req.GetSnapshotId(); id != "" && id != cs.driver.SnapshotID(s) {
+			continue
+		}
+		if id := req.GetSourceVolumeId(); id != "" && id != s.SourceVolumeID {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: cs.newCSISnapshot(s),
+		})
+	}
+
+	start, end, nextToken, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
 // DeleteVolume
 func (cs *ControlServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
 	id := req.GetVolumeId()
 	if id == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -176,18 +426,95 @@ func (cs *ControlServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolume
 
 	exist, err := cs.driver.IsVolume(ctx, id)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 	if exist {
 		err = cs.driver.PurgeVolume(ctx, id)
 	}
 
-	return &csi.DeleteVolumeResponse{}, err
+	return &csi.DeleteVolumeResponse{}, statusFromError(err)
+}
+
+// ListVolumes
+func (cs *ControlServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+
+	volumes, err := cs.driver.ListAllVolumes(ctx)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+
+	start, end, nextToken, err := paginate(len(volumes), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, end-start)
+	for _, v := range volumes[start:end] {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      cs.driver.VolumeID(v),
+				CapacityBytes: v.Capacity,
+			},
+			// listed volumes have readable metadata
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: &csi.VolumeCondition{Message: "healthy"},
+			},
+		})
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// ControllerGetVolume reports the volume as abnormal when its metadata is missing, or the remote can't be read.
+func (cs *ControlServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	response := func(capacity int64, abnormal bool, format string, a ...interface{}) *csi.ControllerGetVolumeResponse {
+		return &csi.ControllerGetVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:      id,
+				CapacityBytes: capacity,
+			},
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: abnormal,
+					Message:  fmt.Sprintf(format, a...),
+				},
+			},
+		}
+	}
+
+	v, err := cs.driver.ReadVolume(ctx, id)
+	if err != nil {
+		return response(0, true, "error reading volume metadata: %s", err), nil
+	}
+	if v != nil {
+		return response(v.Capacity, false, "healthy"), nil
+	}
+
+	exist, err := cs.driver.IsVolumeDir(ctx, id)
+	if err != nil {
+		return response(0, true, "error reading volume directory: %s", err), nil
+	}
+	if !exist {
+		return nil, status.Errorf(codes.NotFound, "Volume with ID '%s' does not exist", id)
+	}
+
+	return response(0, true, "volume directory exists, but its %s file is missing", MetadataFilename), nil
 }
 
 // ValidateVolumeCapabilities
 func (cs *ControlServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
 	id := req.GetVolumeId()
 	if id == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -195,13 +522,13 @@ func (cs *ControlServer) ValidateVolumeCapabilities(ctx context.Context, req *cs
 
 	exist, err := cs.driver.IsVolume(ctx, id)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 	if !exist {
 		return nil, status.Errorf(codes.NotFound, "Volume with ID '%s' does not exist", id)
 	}
 
-	if err := cs.validateVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+	if err := cs.validateVolumeCapabilities(req.GetVolumeCapabilities(), req.GetVolumeContext()); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Invalid capabilities: %s", err)
 	}
 
@@ -213,8 +540,9 @@ func (cs *ControlServer) ValidateVolumeCapabilities(ctx context.Context, req *cs
 	}, nil
 }
 
-// validateVolumeCapabilities validates the given VolumeCapability array is valid
-func (cs *ControlServer) validateVolumeCapabilities(caps []*csi.VolumeCapability) error {
+// validateVolumeCapabilities validates the given VolumeCapability array is valid,
+// for volumes created with the given parameters
+func (cs *ControlServer) validateVolumeCapabilities(caps []*csi.VolumeCapability, parameters map[string]string) error {
 
 	if len(caps) == 0 {
 		return status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
@@ -224,7 +552,54 @@ func (cs *ControlServer) validateVolumeCapabilities(caps []*csi.VolumeCapability
 		if c.GetBlock() != nil {
 			return status.Error(codes.InvalidArgument, "block volume capability not supported")
 		}
+		if _, _, err := parseMountFlags(c.GetMount().GetMountFlags(), ""); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if c.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+			off, err := cs.driver.IsCacheModeOff(parameters)
+			if err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+			if off {
+				return status.Error(codes.InvalidArgument, "multi-node multi-writer access requires a vfs CacheMode of writes or full")
+			}
+		}
 	}
 
 	return nil
 }
+
+// newCSISnapshot converts snapshot metadata into its CSI representation
+func (cs *ControlServer) newCSISnapshot(s *Snapshot) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     cs.driver.SnapshotID(s),
+		SourceVolumeId: s.SourceVolumeID,
+		SizeBytes:      s.Size,
+		CreationTime:   timestamppb.New(s.CreationTime),
+		ReadyToUse:     true,
+	}
+}
+
+// paginate returns the bounds of the requested page of a listing, and the token for the next page.
+// Tokens are the index of the first entry of a page.
+func paginate(total int, startingToken string, maxEntries int32) (start, end int, nextToken string, err error) {
+
+	if maxEntries < 0 {
+		return 0, 0, "", status.Error(codes.InvalidArgument, "max_entries must not be negative")
+	}
+
+	if startingToken != "" {
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting_token: %s", startingToken)
+		}
+	}
+
+	end = total
+	if maxEntries > 0 && start+int(maxEntries) < total {
+		end = start + int(maxEntries)
+		nextToken = strconv.Itoa(end)
+	}
+
+	return start, end, nextToken, nil
+}
@@ -1,23 +1,23 @@
 package csirclone
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path"
-	"strconv"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/rclone/rclone/fs"
-	"github.com/rclone/rclone/fs/fshttp"
 	"github.com/rclone/rclone/fs/rc"
 	"golang.org/x/net/context"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
 )
 
 const (
@@ -25,7 +25,8 @@ const (
 	DefaultDriverEndpoint = "unix:///tmp/csi.sock"
 	DefaultMountType      = "mount2"
 
-	volumeOperationAlreadyExistsFmt = "an operation with the given Volume ID %s already exists"
+	volumeOperationAlreadyExistsFmt   = "an operation with the given Volume ID %s already exists"
+	snapshotOperationAlreadyExistsFmt = "an operation with the given Snapshot ID %s already exists"
 )
 
 type DriverOptions struct {
@@ -33,15 +34,55 @@ type DriverOptions struct {
 	NodeId     string
 	Endpoint   string
 
+	// RcdMode selects how rclone is reached: RcdModeSidecar, the default, or RcdModeEmbedded
+	RcdMode string
+
 	Address  string
 	Username string
 	Password string
 
+	// RCRetries is how many times rc calls failing temporarily are retried, after RCRetryBackoff doubled each time.
+	RCRetries      int
+	RCRetryBackoff time.Duration
+	// RCTimeout limits each attempt of an rc call, unless zero. Long-running calls, like copies, are not limited.
+	RCTimeout time.Duration
+
 	Remote    string
 	MountType string
 
 	MountOpt map[string]string
 	VfsOpt   map[string]string
+
+	// OptOverrideAllow lists the options volumes may override, e.g. "vfsOpt.CacheMode" or "mountOpt.*".
+	// Every option may be overridden when empty.
+	OptOverrideAllow []string
+	// OptOverrideDeny lists the options volumes may not override, even when allowed.
+	OptOverrideDeny []string
+
+	// InlineAllow lists the remotes inline volumes may mount, with their sub-paths, e.g. "datasets:" or "s3:bucket/public".
+	// Inline volumes are refused when empty.
+	InlineAllow []string
+	// InlineWritable allows inline volumes to be mounted read-write, they are read-only otherwise.
+	InlineWritable bool
+
+	// RcloneConfig holds remotes to create with rcd on startup, in rclone config file format.
+	RcloneConfig string
+
+	// StateDir is where the node keeps track of its mounts. Mounts are not restored when empty.
+	StateDir string
+	// ReconcileInterval is how often broken mounts are looked for.
+	ReconcileInterval time.Duration
+
+	// QuotaMode selects what happens when a volume grows beyond its capacity, nothing when empty.
+	QuotaMode string
+	// QuotaInterval is how often the size of mounted volumes is computed.
+	QuotaInterval time.Duration
+
+	// CapacityFallback is reported when the remote can't report its usage.
+	// A negative value causes GetCapacity to fail instead.
+	CapacityFallback int64
+	// CapacitySubtractProvisioned removes the capacity of existing volumes from the reported capacity.
+	CapacitySubtractProvisioned bool
 }
 
 func (o *DriverOptions) Validate() (err error) {
@@ -59,6 +100,35 @@ func (o *DriverOptions) Validate() (err error) {
 		err = errors.New("invalid DriverOptions: MountType required")
 	}
 
+	if o.RCRetries < 0 {
+		err = errors.New("invalid DriverOptions: RCRetries must not be negative")
+	}
+
+	switch o.RcdMode {
+	case "", RcdModeSidecar, RcdModeEmbedded:
+	default:
+		err = fmt.Errorf("invalid DriverOptions: unknown RcdMode '%s'", o.RcdMode)
+	}
+
+	for _, remote := range o.InlineAllow {
+		if _, _, found := cutRemote(remote); !found {
+			err = fmt.Errorf("invalid DriverOptions: InlineAllow '%s' is not a remote", remote)
+		}
+	}
+
+	if socket, ok := strings.CutPrefix(o.Address, unixScheme); ok && !path.IsAbs(socket) {
+		err = fmt.Errorf("invalid DriverOptions: Address '%s' must be an absolute socket path", o.Address)
+	}
+
+	switch o.QuotaMode {
+	case "", QuotaModeWarn, QuotaModeReadOnly:
+		if o.QuotaMode != "" && o.StateDir == "" {
+			err = errors.New("invalid DriverOptions: StateDir required by QuotaMode")
+		}
+	default:
+		err = fmt.Errorf("invalid DriverOptions: unknown QuotaMode '%s'", o.QuotaMode)
+	}
+
 	if o.Username != "" || o.Password != "" {
 		switch {
 		case o.Username == "":
@@ -77,6 +147,30 @@ type Driver struct {
 	WorkDir string
 	Server  NonBlockingGRPCServer
 	Locks   *VolumeLocks
+
+	// Client reaches rclone, as selected by RcdMode. Tests may replace it with a fake.
+	Client RCClient
+	// Mounter replaces the system mounter of the node server when set, e.g. with a fake in tests
+	Mounter mount.Interface
+
+	// Events records kubernetes events about volumes, when set
+	Events record.EventRecorder
+
+	// config guards the options that can be reloaded while running
+	config sync.RWMutex
+
+	// remotesMu guards the updates of the RemotesFilename
+	remotesMu sync.Mutex
+
+	// schemas caches the mount and vfs option schemas of rcd
+	schemas  map[string]optionSchema
+	schemaMu sync.Mutex
+
+	// jobs are the copy jobs running on rcd, by destination
+	jobs   map[string]*copyJob
+	jobsMu sync.Mutex
+
+	stop chan struct{}
 }
 
 func NewDriver(opts *DriverOptions) (d *Driver) {
@@ -94,34 +188,36 @@ func NewDriver(opts *DriverOptions) (d *Driver) {
 		Locks:         NewVolumeLocks(),
 	}
 
+	switch opts.RcdMode {
+	case RcdModeEmbedded:
+		d.Client = &embeddedRCClient{}
+	default:
+		d.Client = newHTTPRCClient(opts.Address, d.credentials)
+	}
+
 	return d
 }
 
-func marshalOpt(opt map[string]string) (string, error) {
+// credentials returns the rcd username and password, which may change when the config is reloaded.
+func (d *Driver) credentials() (username, password string) {
+	d.config.RLock()
+	defer d.config.RUnlock()
+	return d.Username, d.Password
+}
 
-	if opt == nil {
-		return "", nil
-	}
+// setOpt sets key in the json options returned by marshalOpt
+func setOpt(opt string, key string, value interface{}) (string, error) {
 
 	out := map[string]interface{}{}
 
-	for k, v := range opt {
-		switch v {
-		case "true":
-			out[k] = true
-		case "false":
-			out[k] = false
-		default:
-			if i, err := strconv.Atoi(v); err == nil {
-				out[k] = i
-			} else if t, err := time.ParseDuration(v); err == nil {
-				out[k] = t
-			} else {
-				out[k] = v
-			}
+	if opt != "" {
+		if err := json.Unmarshal([]byte(opt), &out); err != nil {
+			return "", fmt.Errorf("error parsing options: %w", err)
 		}
 	}
 
+	out[key] = value
+
 	b, err := json.Marshal(out)
 	if err != nil {
 		return "", err
@@ -130,9 +226,38 @@ func marshalOpt(opt map[string]string) (string, error) {
 	return string(b), nil
 }
 
-func (d *Driver) GetMountOpt() (string, error) {
+// IsCacheModeOff returns true when volumes created with the parameters are mounted without vfs cache,
+// which doesn't support files opened for both reading and writing.
+func (d *Driver) IsCacheModeOff(parameters map[string]string) (bool, error) {
+
+	d.config.RLock()
+	mode := d.VfsOpt["CacheMode"]
+	d.config.RUnlock()
+
+	// the vfs options of the volume are merged into those of the driver
+	overrides, err := VolumeOpt(parameters, ParameterVfsOpt)
+	if err != nil {
+		return false, err
+	}
+	if value, ok := overrides["CacheMode"]; ok {
+		mode = fmt.Sprint(value)
+	}
+
+	switch strings.ToLower(mode) {
+	case "", "off", "0":
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (d *Driver) GetMountOpt(ctx context.Context) (string, error) {
 
-	out, err := marshalOpt(d.MountOpt)
+	d.config.RLock()
+	opt := d.MountOpt
+	d.config.RUnlock()
+
+	out, err := d.marshalOpt(ctx, OptBlockMount, opt)
 	if err != nil {
 		return "", err
 	}
@@ -140,9 +265,13 @@ func (d *Driver) GetMountOpt() (string, error) {
 	return out, nil
 }
 
-func (d *Driver) GetVfsOpt() (string, error) {
+func (d *Driver) GetVfsOpt(ctx context.Context) (string, error) {
+
+	d.config.RLock()
+	opt := d.VfsOpt
+	d.config.RUnlock()
 
-	out, err := marshalOpt(d.VfsOpt)
+	out, err := d.marshalOpt(ctx, OptBlockVfs, opt)
 	if err != nil {
 		return "", err
 	}
@@ -163,79 +292,269 @@ func (d *Driver) Start() {
 		versionMeta + "\n")
 
 	d.Server = NewNonBlockingGRPCServer()
+	d.stop = make(chan struct{})
+
+	ns := NewNodeServer(d)
 
 	d.Server.Start(
 		d.Endpoint,
 		NewIdentityServer(d),
 		NewControlServer(d),
-		NewNodeServer(d),
+		ns,
 	)
+
+	if ns.state != nil {
+		go ns.RunReconciler(d.ReconcileInterval, d.stop)
+	}
+	if ns.state != nil && d.QuotaMode != "" {
+		go ns.RunQuotaEnforcer(d.QuotaInterval, d.stop)
+	}
 }
 
 func (d *Driver) Stop() {
+	close(d.stop)
 	d.Server.Stop()
+
+	// embedded mounts don't outlive the driver, release them while it's still running
+	if d.RcdMode == RcdModeEmbedded {
+		if _, err := d.RC(context.Background(), "mount/unmountall", rc.Params{}); err != nil {
+			klog.Errorf("error unmounting volumes: %s", err)
+		}
+	}
 }
 
 func (d *Driver) Wait() {
 	d.Server.Wait()
 }
 
-// mostly copied from rclone/cmd/rc.doCall()
-func (d *Driver) RC(ctx context.Context, path string, in rc.Params) (out rc.Params, err error) {
+// RemoteUsage is the subset of the rclone about output used by the driver.
+// Fields are nil when not reported by the backend.
+type RemoteUsage struct {
+	Total *int64 `json:"total,omitempty"`
+	Used  *int64 `json:"used,omitempty"`
+	Free  *int64 `json:"free,omitempty"`
+}
+
+// About returns ErrAboutNotSupported if the backend can't report its usage.
+func (d *Driver) About(ctx context.Context, remote string) (*RemoteUsage, error) {
 
-	url := d.Address + path
-	data, err := json.Marshal(in)
+	out, err := d.RC(ctx, "operations/about", rc.Params{
+		"fs": remoteFs(ctx, remote),
+	})
 	if err != nil {
-		return nil, err
+		switch {
+		case errors.Is(err, ErrAboutNotSupported):
+			return nil, ErrAboutNotSupported
+		case errors.Is(err, ErrNotFound):
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error calling operations/about: %w", err)
 	}
 
-	// Prep request
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
-	if err != nil {
-		return nil, err
+	usage := &RemoteUsage{}
+	if err := rc.Reshape(usage, out); err != nil {
+		return nil, fmt.Errorf("error parsing operations/about: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	if d.Username != "" || d.Password != "" {
-		req.SetBasicAuth(d.Username, d.Password)
+	return usage, nil
+}
+
+// AvailableCapacity returns the free space of the remote,
+// falling back to CapacityFallback when the remote doesn't report it.
+// A remote root that doesn't exist yet reports the fallback, or 0 without one.
+func (d *Driver) AvailableCapacity(ctx context.Context, remote string) (int64, error) {
+
+	usage, err := d.About(ctx, remote)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		// the remote root is only created along with the first volume,
+		// and GetCapacity is polled by the provisioner, so it must not create it
+		klog.V(4).Infof("remote %s does not exist yet, reporting fallback capacity", remote)
+		return max(d.CapacityFallback, 0), nil
+	case err != nil && !errors.Is(err, ErrAboutNotSupported):
+		return 0, err
 	}
 
-	// Do HTTP request
-	client := fshttp.NewClient(ctx)
+	var available int64
+	switch {
+	case usage != nil && usage.Free != nil:
+		available = *usage.Free
+	case usage != nil && usage.Total != nil && usage.Used != nil:
+		available = *usage.Total - *usage.Used
+	case d.CapacityFallback >= 0:
+		klog.V(4).Infof("remote %s does not report free space, using fallback capacity", remote)
+		return d.CapacityFallback, nil
+	default:
+		return 0, ErrAboutNotSupported
+	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if d.CapacitySubtractProvisioned {
+		// the free space is shared by every remote of the backend, e.g. the paths of a bucket
+		volumes, err := d.ListAllVolumes(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range volumes {
+			if backendOf(v.Remote) == backendOf(remote) {
+				available -= v.Capacity
+			}
+		}
 	}
-	defer fs.CheckClose(resp.Body, &err)
 
-	// Read response
-	body, err := io.ReadAll(resp.Body)
-	bodyString := strings.TrimSpace(string(body))
-	if err != nil {
-		return nil, err
+	if available < 0 {
+		available = 0
 	}
 
-	// Parse output
-	out = make(rc.Params)
-	err = json.NewDecoder(strings.NewReader(bodyString)).Decode(&out)
+	return available, nil
+}
+
+// RemoteFromParameters returns the remote selected by the volume parameters,
+// defaulting to the driver remote.
+func (d *Driver) RemoteFromParameters(parameters map[string]string) string {
+
+	remote := d.DefaultRemote()
+	if value := parameters[ParameterRemote]; value != "" {
+		remote = value
+	}
+
+	return joinRemote(remote, strings.Trim(parameters[ParameterPath], "/"))
+}
+
+// IsInlineAllowed returns an error unless inline volumes may mount the remote.
+// The remote must be listed in InlineAllow, or be a sub-path of a listed remote,
+// and must not hold volumes, nor be a parent of a remote holding volumes.
+func (d *Driver) IsInlineAllowed(ctx context.Context, remote string) error {
+
+	// the path is cut from the remote first, "datasets:../x" would hide ".." otherwise
+	if _, p := splitRemote(remote); p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("%w: inline volumes may not mount %s, which escapes its remote", ErrPermissionDenied, remote)
+	}
+
+	allowed := false
+	for _, allow := range d.InlineAllow {
+		if isUnderRemote(remote, allow) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: inline volumes may not mount %s", ErrPermissionDenied, remote)
+	}
+
+	remotes, err := d.Remotes(ctx)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("error listing the remotes holding volumes: %w", err)
 	}
 
-	// Check we got 200 OK
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("operation %q failed: %v", path, out["error"])
+	for _, r := range remotes {
+		if isUnderRemote(remote, r) || isUnderRemote(r, remote) {
+			return fmt.Errorf("%w: inline volumes may not mount %s, which holds the volumes of %s", ErrPermissionDenied, remote, r)
+		}
 	}
 
-	return
+	return nil
+}
+
+// isUnderRemote returns true when remote is base, or one of its sub-paths,
+// e.g. "name:dir/sub" is under "name:dir" and "name:", but not under "name:di".
+// Relative paths are not under absolute ones, and the other way around, e.g. "sftp:/etc" is not under "sftp:".
+func isUnderRemote(remote, base string) bool {
+
+	spec, p := splitRemote(remote)
+	baseSpec, baseP := splitRemote(base)
+
+	switch {
+	case spec != baseSpec:
+		return false
+	case baseP == "":
+		return !strings.HasPrefix(p, "/") && p != ".." && !strings.HasPrefix(p, "../")
+	}
+
+	return p == baseP || strings.HasPrefix(p, strings.TrimSuffix(baseP, "/")+"/")
+}
+
+// splitRemote returns the name of the remote, with any connection string parameters, and its cleaned path,
+// which is empty at the root of the remote. Local paths have no name.
+func splitRemote(remote string) (spec, p string) {
+
+	spec, p, found := cutRemote(remote)
+	if !found {
+		spec, p = "", remote
+	}
+
+	if p = path.Clean(p); p == "." {
+		p = ""
+	}
+
+	return spec, p
+}
+
+// backendOf returns the backend part of a remote, e.g. "name:" for "name:path",
+// ":s3:" for the on-the-fly remote ":s3:bucket", and "" for local paths.
+func backendOf(remote string) string {
+	name, rest, found := strings.Cut(remote, ":")
+	switch {
+	case !found:
+		return ""
+	case name == "":
+		backend, _, _ := strings.Cut(rest, ":")
+		return ":" + backend + ":"
+	default:
+		return name + ":"
+	}
+}
+
+// joinRemote returns the directory p of remote, e.g. "name:" and "dir" give "name:dir",
+// the directory rcd uses for fs "name:" and remote "dir".
+func joinRemote(remote, p string) string {
+	if p == "" || strings.HasSuffix(remote, ":") || strings.HasSuffix(remote, "/") {
+		return remote + p
+	}
+	return remote + "/" + p
+}
+
+// joinID returns the CSI identifier for a directory on a remote.
+// Directories on the driver remote are identified by name alone,
+// others are prefixed with their remote, which never contains the base58 names.
+func (d *Driver) joinID(remote, name string) string {
+	if remote == d.DefaultRemote() {
+		return name
+	}
+	return remote + "/" + name
+}
+
+// splitID reverses joinID, returning the remote and directory name.
+func (d *Driver) splitID(id string) (remote, name string) {
+	if i := strings.LastIndex(id, "/"); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+	return d.DefaultRemote(), id
+}
+
+// DefaultRemote returns the driver remote, which may change when the config is reloaded.
+func (d *Driver) DefaultRemote() string {
+	d.config.RLock()
+	defer d.config.RUnlock()
+	return d.Remote
+}
+
+// VolumeID returns the CSI volume ID of the volume.
+func (d *Driver) VolumeID(v *Volume) string {
+	return d.joinID(v.Remote, v.ID)
+}
+
+// SnapshotID returns the CSI snapshot ID of the snapshot.
+func (d *Driver) SnapshotID(s *Snapshot) string {
+	return d.joinID(s.Remote, s.ID)
 }
 
 func (d *Driver) IsVolume(ctx context.Context, id string) (exist bool, err error) {
 
+	remote, name := d.splitID(id)
+
 	out, err := d.RC(ctx, "operations/stat", rc.Params{
-		"fs":     d.Remote,
-		"remote": id + "/" + MetadataFilename,
+		"fs":     remoteFs(ctx, remote),
+		"remote": name + "/" + MetadataFilename,
 		"opt":    `{"recurse": false}`,
 	})
 	if err != nil {
@@ -248,6 +567,23 @@ func (d *Driver) IsVolume(ctx context.Context, id string) (exist bool, err error
 	return
 }
 
+// IsVolumeDir returns true when the directory of the volume exists, with or without metadata.
+func (d *Driver) IsVolumeDir(ctx context.Context, id string) (bool, error) {
+
+	remote, name := d.splitID(id)
+
+	out, err := d.RC(ctx, "operations/stat", rc.Params{
+		"fs":     remoteFs(ctx, remote),
+		"remote": name,
+		"opt":    `{"dirsOnly": true}`,
+	})
+	if err != nil {
+		return false, fmt.Errorf("error calling operations/stat: %w", err)
+	}
+
+	return out["item"] != nil, nil
+}
+
 func (d *Driver) copyOrMoveFile(ctx context.Context, srcRemote, srcPath, destRemote, destPath string, move bool) error {
 
 	op := "copy"
@@ -264,9 +600,9 @@ func (d *Driver) copyOrMoveFile(ctx context.Context, srcRemote, srcPath, destRem
 
 	if err != nil {
 		switch {
-		case strings.HasSuffix(err.Error(), "object not found"):
+		case errors.Is(err, ErrNotFound):
 			err = ErrNotFound
-		case strings.HasSuffix(err.Error(), "didn't find section in config file"):
+		case errors.Is(err, ErrRemoteNotFound):
 			err = ErrRemoteNotFound
 		default:
 			err = fmt.Errorf("error copying file: %w", err)
@@ -284,26 +620,26 @@ func (d *Driver) MoveFile(ctx context.Context, srcRemote, srcPath, destRemote, d
 	return d.copyOrMoveFile(ctx, srcRemote, srcPath, destRemote, destPath, true)
 }
 
-// ReadVolume returns nil if no volume is found
-func (d *Driver) ReadVolume(ctx context.Context, id string) (*Volume, error) {
+// readMetadata copies a remote metadata file to a local temp file and returns its contents.
+func (d *Driver) readMetadata(ctx context.Context, remote, remotePath string) ([]byte, error) {
 
 	// create tmpfile to get a safe place to write
 	tmpFile, err := os.CreateTemp(d.WorkDir, "")
-	defer os.Remove(tmpFile.Name())
 	if err != nil {
 		return nil, fmt.Errorf("error creating temp file: %w", err)
 	}
+	defer os.Remove(tmpFile.Name())
 	if err := tmpFile.Close(); err != nil {
 		return nil, fmt.Errorf("error closing temp file: %w", err)
 	}
 
 	// overwrite the file with the remote metadata file
 	err = d.CopyFile(ctx,
-		d.Remote, id+"/"+MetadataFilename,
+		remoteFs(ctx, remote), remotePath,
 		path.Dir(tmpFile.Name()), path.Base(tmpFile.Name()))
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
-			return nil, nil
+			return nil, err
 		}
 		return nil, fmt.Errorf("error copying file with rclone: %w", err)
 	}
@@ -323,19 +659,11 @@ func (d *Driver) ReadVolume(ctx context.Context, id string) (*Volume, error) {
 		return nil, fmt.Errorf("error closing metadata file: %w", err)
 	}
 
-	v := &Volume{}
-	err = v.Unmarshal(b)
-
-	return v, err
+	return b, nil
 }
 
-func (d *Driver) WriteVolume(ctx context.Context, v *Volume) error {
-
-	b, err := v.Marshal(true)
-	if err != nil {
-		return err
-	}
-	b = append(b, []byte("\n")...)
+// writeMetadata writes the contents to a local temp file and moves it to the remote.
+func (d *Driver) writeMetadata(ctx context.Context, remote, remotePath string, b []byte) error {
 
 	tmpFile, err := os.CreateTemp(d.WorkDir, "")
 	if err != nil {
@@ -352,11 +680,174 @@ func (d *Driver) WriteVolume(ctx context.Context, v *Volume) error {
 		return fmt.Errorf("error writing temp file: %w", err)
 	}
 
-	err = d.MoveFile(ctx,
+	return d.MoveFile(ctx,
 		path.Dir(tmpFile.Name()), path.Base(tmpFile.Name()),
-		v.Remote, v.ID+"/"+MetadataFilename)
+		remoteFs(ctx, remote), remotePath)
+}
 
-	return err
+// ReadVolume returns nil if no volume is found
+func (d *Driver) ReadVolume(ctx context.Context, id string) (*Volume, error) {
+
+	remote, name := d.splitID(id)
+
+	b, err := d.readMetadata(ctx, remote, name+"/"+MetadataFilename)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	v := &Volume{}
+	err = v.Unmarshal(b)
+
+	return v, err
+}
+
+// ListVolumes returns all volumes on the remote with readable metadata, sorted by ID.
+func (d *Driver) ListVolumes(ctx context.Context, remote string) ([]*Volume, error) {
+
+	items, err := d.listDir(ctx, remote, "", `{"dirsOnly": true}`)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	volumes := make([]*Volume, 0, len(items))
+	for _, item := range items {
+		// skip the snapshots area, and any other hidden directories
+		if strings.HasPrefix(item.Name, ".") {
+			continue
+		}
+		v, err := d.ReadVolume(ctx, d.joinID(remote, item.Name))
+		if err != nil {
+			return nil, err
+		}
+		// skip directories without metadata, e.g. volumes still being populated
+		if v == nil {
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].ID < volumes[j].ID
+	})
+
+	return volumes, nil
+}
+
+// remoteList is the content of the RemotesFilename
+type remoteList struct {
+	Remotes []string `json:"remotes"`
+}
+
+// Remotes returns the driver remote, followed by the other remotes holding volumes.
+func (d *Driver) Remotes(ctx context.Context) ([]string, error) {
+
+	list, err := d.readRemoteList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{d.DefaultRemote()}, list.Remotes...), nil
+}
+
+func (d *Driver) readRemoteList(ctx context.Context) (*remoteList, error) {
+
+	list := &remoteList{}
+
+	// the list lives on the driver remote, which never uses the secrets of other remotes
+	b, err := d.readMetadata(withoutSecrets(ctx), d.DefaultRemote(), RemotesFilename)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return list, nil
+	case err != nil:
+		return nil, fmt.Errorf("error reading remote list: %w", err)
+	}
+
+	if err := json.Unmarshal(b, list); err != nil {
+		return nil, fmt.Errorf("error parsing remote list: %w", err)
+	}
+
+	return list, nil
+}
+
+// RegisterRemote records a remote holding volumes besides the driver remote,
+// so that it is listed along with the driver remote.
+func (d *Driver) RegisterRemote(ctx context.Context, remote string) error {
+
+	if remote == d.DefaultRemote() {
+		return nil
+	}
+
+	d.remotesMu.Lock()
+	defer d.remotesMu.Unlock()
+
+	list, err := d.readRemoteList(ctx)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(list.Remotes, remote) {
+		return nil
+	}
+
+	list.Remotes = append(list.Remotes, remote)
+	sort.Strings(list.Remotes)
+
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeMetadata(withoutSecrets(ctx), d.DefaultRemote(), RemotesFilename, append(b, '\n')); err != nil {
+		return fmt.Errorf("error writing remote list: %w", err)
+	}
+
+	return nil
+}
+
+// ListAllVolumes returns the volumes of every remote, sorted by volume ID.
+// The other remotes than the driver remote are skipped when they can't be listed,
+// e.g. when they need the secrets of a provisioner.
+func (d *Driver) ListAllVolumes(ctx context.Context) ([]*Volume, error) {
+
+	remotes, err := d.Remotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []*Volume
+	for i, remote := range remotes {
+		list, err := d.ListVolumes(ctx, remote)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			klog.Warningf("error listing volumes of remote %s, skipping: %s", remote, err)
+			continue
+		}
+		volumes = append(volumes, list...)
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return d.VolumeID(volumes[i]) < d.VolumeID(volumes[j])
+	})
+
+	return volumes, nil
+}
+
+func (d *Driver) WriteVolume(ctx context.Context, v *Volume) error {
+
+	b, err := v.Marshal(true)
+	if err != nil {
+		return err
+	}
+	b = append(b, []byte("\n")...)
+
+	return d.writeMetadata(ctx, v.Remote, v.ID+"/"+MetadataFilename, b)
 }
 
 func (d *Driver) ExpandVolume(ctx context.Context, id string, capacity int64) error {
@@ -365,61 +856,407 @@ func (d *Driver) ExpandVolume(ctx context.Context, id string, capacity int64) er
 	if err != nil {
 		return err
 	}
+	if v == nil {
+		return ErrNotFound
+	}
 
 	v.Capacity = capacity
 
 	return d.WriteVolume(ctx, v)
 }
 
+// GetVolumeUsage returns the volume and the size of its contents.
+// The size isn't recorded in the metadata, which only the controller writes.
+func (d *Driver) GetVolumeUsage(ctx context.Context, id string) (*Volume, int64, error) {
+
+	v, err := d.ReadVolume(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if v == nil {
+		return nil, 0, ErrNotFound
+	}
+
+	remote, name := d.splitID(id)
+
+	out, err := d.RC(ctx, "operations/size", rc.Params{
+		"fs": remoteFs(ctx, joinRemote(remote, name)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	used, err := out.GetInt64("bytes")
+	if err != nil {
+		return nil, 0, fmt.Errorf("error parsing operations/size: %w", err)
+	}
+
+	return v, used, nil
+}
+
 func (d *Driver) PurgeVolume(ctx context.Context, id string) error {
 
+	remote, name := d.splitID(id)
+
 	_, err := d.RC(ctx, "operations/purge", rc.Params{
-		"fs":     d.Remote,
-		"remote": id,
+		"fs":     remoteFs(ctx, remote),
+		"remote": name,
 	})
 
 	return err
 
 }
 
-func (d *Driver) MountVolume(ctx context.Context, id, mountPoint string, parameters map[string]string) error {
+// ReadSnapshot returns nil if no snapshot is found
+func (d *Driver) ReadSnapshot(ctx context.Context, id string) (*Snapshot, error) {
 
-	mountOpt, err := d.GetMountOpt()
+	remote, name := d.splitID(id)
+
+	b, err := d.readMetadata(ctx, remote, SnapshotsDirname+"/"+name+"/"+SnapshotMetadataFilename)
 	if err != nil {
-		return err
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	vfsOpt, err := d.GetVfsOpt()
+	s := &Snapshot{}
+	err = s.Unmarshal(b)
+
+	return s, err
+}
+
+func (d *Driver) WriteSnapshot(ctx context.Context, s *Snapshot) error {
+
+	b, err := s.Marshal(true)
 	if err != nil {
 		return err
 	}
+	b = append(b, []byte("\n")...)
+
+	return d.writeMetadata(ctx, s.Remote, s.Path()+"/"+SnapshotMetadataFilename, b)
+}
+
+// CreateSnapshot copies the source volume into the snapshots area of its remote, then records the snapshot metadata.
+// The metadata is written last, so a snapshot is only visible once the copy has completed.
+func (d *Driver) CreateSnapshot(ctx context.Context, s *Snapshot, source *Volume) error {
+
+	err := d.copyDir(ctx, joinRemote(source.Remote, source.ID), joinRemote(s.Remote, s.Path()))
+	if err != nil {
+		return fmt.Errorf("error copying volume: %w", err)
+	}
+
+	return d.WriteSnapshot(ctx, s)
+}
+
+// RestoreSnapshot copies the snapshot contents into the volume, leaving out the snapshot metadata.
+func (d *Driver) RestoreSnapshot(ctx context.Context, v *Volume, s *Snapshot) error {
+
+	err := d.copyDir(ctx,
+		joinRemote(s.Remote, s.Path()), joinRemote(v.Remote, v.ID),
+		MetadataFilename, SnapshotMetadataFilename)
+	if err != nil {
+		return fmt.Errorf("error restoring snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// CloneVolume copies the source volume contents into the volume, leaving out the source metadata.
+func (d *Driver) CloneVolume(ctx context.Context, v, source *Volume) error {
+
+	err := d.copyDir(ctx,
+		joinRemote(source.Remote, source.ID), joinRemote(v.Remote, v.ID),
+		MetadataFilename)
+	if err != nil {
+		return fmt.Errorf("error cloning volume: %w", err)
+	}
+
+	return nil
+}
+
+// copyDir copies a directory server-side, skipping the given top level files.
+// The copy runs as an rcd job, which outlives ctx, see runCopyJob.
+func (d *Driver) copyDir(ctx context.Context, srcFs, dstFs string, exclude ...string) error {
 
 	in := rc.Params{
-		"fs":         d.Remote + "/" + id,
-		"mountPoint": mountPoint,
-		"mountType":  d.MountType,
-		"mountOpt":   mountOpt,
+		"srcFs":              remoteFs(ctx, srcFs),
+		"dstFs":              remoteFs(ctx, dstFs),
+		"createEmptySrcDirs": true,
+	}
+
+	if len(exclude) > 0 {
+		rules := make([]string, len(exclude))
+		for i, name := range exclude {
+			rules[i] = "/" + name
+		}
+		in["_filter"] = rc.Params{"ExcludeRule": rules}
+	}
+
+	return d.runCopyJob(ctx, dstFs, in)
+}
+
+func (d *Driver) PurgeSnapshot(ctx context.Context, id string) error {
+
+	remote, name := d.splitID(id)
+
+	_, err := d.RC(ctx, "operations/purge", rc.Params{
+		"fs":     remoteFs(ctx, remote),
+		"remote": SnapshotsDirname + "/" + name,
+	})
+
+	return err
+}
+
+// ListSnapshots returns all snapshots on the remote with readable metadata, sorted by ID.
+func (d *Driver) ListSnapshots(ctx context.Context, remote string) ([]*Snapshot, error) {
+
+	items, err := d.listDir(ctx, remote, SnapshotsDirname, `{"dirsOnly": true}`)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	snapshots := make([]*Snapshot, 0, len(items))
+	for _, item := range items {
+		s, err := d.ReadSnapshot(ctx, d.joinID(remote, item.Name))
+		if err != nil {
+			return nil, err
+		}
+		// skip snapshots that are still being copied
+		if s == nil {
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+
+	return snapshots, nil
+}
+
+// ListAllSnapshots returns the snapshots of every remote holding volumes, sorted by id.
+// Remotes that can't be listed are skipped, like in ListAllVolumes, and so are those no longer configured.
+func (d *Driver) ListAllSnapshots(ctx context.Context) ([]*Snapshot, error) {
+
+	remotes, err := d.Remotes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	for i, remote := range remotes {
+		list, err := d.ListSnapshots(ctx, remote)
+		if err != nil {
+			if errors.Is(err, ErrRemoteNotFound) {
+				continue
+			}
+			if i == 0 {
+				return nil, err
+			}
+			klog.Warningf("error listing snapshots of remote %s, skipping: %s", remote, err)
+			continue
+		}
+		snapshots = append(snapshots, list...)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return d.SnapshotID(snapshots[i]) < d.SnapshotID(snapshots[j])
+	})
+
+	return snapshots, nil
+}
+
+type listItem struct {
+	Path  string `json:"Path"`
+	Name  string `json:"Name"`
+	Size  int64  `json:"Size"`
+	IsDir bool   `json:"IsDir"`
+}
+
+// listDir returns ErrNotFound if the directory does not exist
+func (d *Driver) listDir(ctx context.Context, remote, dir, opt string) ([]listItem, error) {
+
+	out, err := d.RC(ctx, "operations/list", rc.Params{
+		"fs":     remoteFs(ctx, remote),
+		"remote": dir,
+		"opt":    opt,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotFound):
+			return nil, ErrNotFound
+		case errors.Is(err, ErrRemoteNotFound):
+			return nil, ErrRemoteNotFound
+		}
+		return nil, fmt.Errorf("error calling operations/list: %w", err)
+	}
+
+	var items []listItem
+	if err := out.GetStruct("list", &items); err != nil {
+		return nil, fmt.Errorf("error parsing operations/list: %w", err)
+	}
+
+	return items, nil
+}
+
+// NewMount returns the mount of a volume at mountPoint,
+// using the driver options unless overridden by the volume parameters.
+func (d *Driver) NewMount(ctx context.Context, id, mountPoint string, parameters map[string]string) (*Mount, error) {
+
+	d.config.RLock()
+	defaultMountOpt, defaultVfsOpt := d.MountOpt, d.VfsOpt
+	d.config.RUnlock()
+
+	mountOpt, err := d.mergeOpt(ctx, OptBlockMount, ParameterMountOpt, defaultMountOpt, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	vfsOpt, err := d.mergeOpt(ctx, OptBlockVfs, ParameterVfsOpt, defaultVfsOpt, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, name := d.splitID(id)
+
+	m := &Mount{
+		VolumeID:   id,
+		MountPoint: mountPoint,
+		Fs:         joinRemote(remote, name),
+		MountType:  d.MountType,
+		MountOpt:   mountOpt,
+		VfsOpt:     vfsOpt,
+	}
+
+	// allow overrides at the volume definition
+	if value, ok := parameters[ParameterMountType]; ok {
+		if err := d.IsOverrideAllowed(ParameterMountType); err != nil {
+			return nil, err
+		}
+		m.MountType = value
+	}
+
+	return m, nil
+}
+
+// MountVolume asks rcd to mount the volume
+func (d *Driver) MountVolume(ctx context.Context, m *Mount) error {
+
+	vfsOpt := m.VfsOpt
+	m.QuotaReadOnly = m.QuotaExceeded && d.QuotaMode == QuotaModeReadOnly
+	if m.ReadOnly || m.QuotaReadOnly {
+		var err error
+		if vfsOpt, err = setOpt(vfsOpt, "ReadOnly", true); err != nil {
+			return err
+		}
+	}
+
+	in := rc.Params{
+		"fs":         remoteFs(ctx, m.Fs),
+		"mountPoint": m.MountPoint,
+		"mountType":  m.MountType,
+		"mountOpt":   m.MountOpt,
 		"vfsOpt":     vfsOpt,
 	}
 	for _, key := range []string{"mountType", "mountOpt", "vfsOpt"} {
-		// allow overrides at the volume definition
-		if value, ok := parameters[key]; ok {
-			in[key] = value
-		}
 		// delete any keys with empty values
 		if in[key] == "" {
 			delete(in, key)
 		}
 	}
 
-	// TODO: Add retry loop?
-	lockKey := fmt.Sprintf("%s-%s", id, mountPoint)
+	lockKey := fmt.Sprintf("%s-%s", m.VolumeID, m.MountPoint)
 	if !d.Locks.TryAcquire(lockKey) {
-		return fmt.Errorf(volumeOperationAlreadyExistsFmt, id)
+		return fmt.Errorf(volumeOperationAlreadyExistsFmt, m.VolumeID)
 	}
 	defer d.Locks.Release(lockKey)
 
-	_, err = d.RC(ctx, "mount/mount", in)
+	_, err := d.RC(ctx, "mount/mount", in)
+
+	// the response may have been lost after rcd mounted the volume
+	var retryable *RetryableError
+	if errors.As(err, &retryable) {
+		if mountPoints, listErr := d.ListMounts(ctx); listErr == nil && slices.Contains(mountPoints, m.MountPoint) {
+			klog.V(2).Infof("mount/mount failed, but rcd serves %s: %s", m.MountPoint, err)
+			return nil
+		}
+	}
 
 	return err
 }
+
+// ListMounts returns the mount points rcd is serving.
+func (d *Driver) ListMounts(ctx context.Context) ([]string, error) {
+
+	out, err := d.RC(ctx, "mount/listmounts", rc.Params{})
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []struct {
+		MountPoint string
+	}
+	if err := out.GetStruct("mountPoints", &mounts); err != nil {
+		return nil, fmt.Errorf("error parsing mount/listmounts: %w", err)
+	}
+
+	mountPoints := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		mountPoints = append(mountPoints, m.MountPoint)
+	}
+
+	return mountPoints, nil
+}
+
+// UnmountVolume asks rcd to unmount the mount at mountPoint.
+// ErrMountNotFound is returned when rcd doesn't know about the mount.
+func (d *Driver) UnmountVolume(ctx context.Context, mountPoint string) error {
+
+	_, err := d.RC(ctx, "mount/unmount", rc.Params{
+		"mountPoint": mountPoint,
+	})
+	if errors.Is(err, ErrMountNotFound) {
+		return ErrMountNotFound
+	}
+
+	return err
+}
+
+// VfsStats are the health indicators of the VFS serving a mount
+type VfsStats struct {
+	ErroredFiles      int  `json:"erroredFiles"`
+	UploadsInProgress int  `json:"uploadsInProgress"`
+	UploadsQueued     int  `json:"uploadsQueued"`
+	OutOfSpace        bool `json:"outOfSpace"`
+}
+
+// GetVfsStats returns the stats of the VFS cache serving remote.
+// ErrVfsNotFound is returned when no single VFS serves remote,
+// and nil stats when the VFS has no disk cache.
+func (d *Driver) GetVfsStats(ctx context.Context, remote string) (*VfsStats, error) {
+
+	out, err := d.RC(ctx, "vfs/stats", rc.Params{
+		"fs": remoteFs(ctx, remote),
+	})
+	if err != nil {
+		if errors.Is(err, ErrVfsNotFound) {
+			return nil, ErrVfsNotFound
+		}
+		return nil, err
+	}
+
+	stats := &VfsStats{}
+	if err := out.GetStruct("diskCache", stats); err != nil {
+		if rc.IsErrParamNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error parsing vfs/stats: %w", err)
+	}
+
+	return stats, nil
+}
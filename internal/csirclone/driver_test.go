@@ -1,6 +1,7 @@
 package csirclone_test
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path"
@@ -10,14 +11,18 @@ import (
 	. "github.com/cornfeedhobo/csi-driver-rclone/internal/csirclone"
 	"github.com/kubernetes-csi/csi-test/v5/pkg/sanity"
 	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
 	_ "github.com/rclone/rclone/backend/all" // import all backends
 	"github.com/rclone/rclone/cmd"
-	_ "github.com/rclone/rclone/cmd/all"    // import all commands
+	_ "github.com/rclone/rclone/cmd/all" // import all commands
+	"github.com/rclone/rclone/fs/rc"
 	_ "github.com/rclone/rclone/lib/plugin" // import plugins
 )
 
 var _ = Describe("Driver", Ordered, func() {
 
+	const rcdSocket = "/tmp/csi-rcd.sock"
+
 	var driver *Driver
 
 	var cleanTmpDirs = func() {
@@ -25,6 +30,7 @@ var _ = Describe("Driver", Ordered, func() {
 		os.RemoveAll(path.Join(os.TempDir(), "csi-mount"))
 		os.RemoveAll(path.Join(os.TempDir(), "csi-staging"))
 		os.RemoveAll(path.Join(os.TempDir(), DefaultDriverName))
+		os.Remove(rcdSocket)
 	}
 
 	var runRcd = func() {
@@ -49,6 +55,7 @@ var _ = Describe("Driver", Ordered, func() {
 				"rclone",
 				"rcd",
 				"--rc-addr=0.0.0.0:5572",
+				"--rc-addr=unix://" + rcdSocket,
 				"--rc-no-auth",
 				"--verbose=2",
 				"--config=" + fh.Name(),
@@ -97,6 +104,21 @@ var _ = Describe("Driver", Ordered, func() {
 		println()
 	})
 
+	It("calls rcd over a unix socket", func() {
+		client := NewDriver(&DriverOptions{
+			NodeId:     "csiTest",
+			DriverName: DefaultDriverName,
+			Endpoint:   "unix:///tmp/csi-unused.sock",
+			Address:    "unix://" + rcdSocket,
+			Remote:     "unittest:/tmp/csi-rclone",
+			MountType:  "mount2",
+		})
+
+		out, err := client.RC(context.Background(), "rc/noop", rc.Params{"over": "socket"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(HaveKeyWithValue("over", "socket"))
+	})
+
 	Describe("CSI sanity", func() {
 		config := sanity.NewTestConfig()
 		config.Address = "unix:/tmp/csi.sock"
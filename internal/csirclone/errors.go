@@ -1,10 +1,156 @@
 package csirclone
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
 
 var (
 	ErrNotFound          = errors.New("metadata file not found")
 	ErrRemoteNotFound    = errors.New("didn't find section in config file")
 	ErrMetaWrongID       = errors.New("different id found in metadata file")
 	ErrMetaWrongCapacity = errors.New("different capacity found in metadata file")
+	ErrMetaWrongSource   = errors.New("different source volume found in metadata file")
+	ErrAboutNotSupported = errors.New("remote does not report free space")
+	ErrMountNotFound     = errors.New("mount not found")
+	ErrVfsNotFound       = errors.New("no vfs serves the remote")
+	ErrMethodNotFound    = errors.New("rc method not found")
+	ErrPermissionDenied  = errors.New("permission denied")
+	ErrNoSpace           = errors.New("no space left on the remote")
 )
+
+// RCError is the error reported by rclone for a failed rc call, decoded from its json error body.
+// It matches the error sentinels of the driver with errors.Is, e.g. ErrNotFound for missing objects.
+type RCError struct {
+	// Path is the rc method, e.g. "operations/stat"
+	Path string
+	// Status is the http status chosen by rclone, e.g. 404 for missing objects and 500 for most failures
+	Status int
+	// Message is the error returned by the method, with secrets redacted
+	Message string
+}
+
+func (e *RCError) Error() string {
+	return fmt.Sprintf("operation %q failed: %s", e.Path, e.Message)
+}
+
+// rcErrorKinds recognizes the errors of rclone, which only tells them apart by message and status.
+// Messages are more specific than statuses, so the first kind matching the message wins,
+// then the first kind matching the status.
+var rcErrorKinds = []struct {
+	err      error
+	status   []int
+	messages []string
+}{
+	{err: ErrMethodNotFound, messages: []string{"couldn't find method"}},
+	{err: ErrMountNotFound, messages: []string{"mount not found"}},
+	{err: ErrVfsNotFound, messages: []string{"no VFS found with name", "more than one VFS active"}},
+	{err: ErrRemoteNotFound, messages: []string{"didn't find section in config file"}},
+	{err: ErrAboutNotSupported, messages: []string{"doesn't support about"}},
+	{
+		err:      ErrPermissionDenied,
+		status:   []int{http.StatusUnauthorized, http.StatusForbidden},
+		messages: []string{"permission denied", "access denied", "accessdenied", "forbidden"},
+	},
+	{
+		err:      ErrNoSpace,
+		status:   []int{http.StatusInsufficientStorage},
+		messages: []string{"no space left on device", "quota exceeded", "quota has been exceeded", "insufficient storage", "disk quota"},
+	},
+	{
+		err:      ErrNotFound,
+		status:   []int{http.StatusNotFound},
+		messages: []string{"object not found", "directory not found"},
+	},
+}
+
+// Kind returns the driver error sentinel matching the error, or nil when it has none.
+func (e *RCError) Kind() error {
+
+	message := strings.ToLower(e.Message)
+
+	for _, kind := range rcErrorKinds {
+		for _, m := range kind.messages {
+			if strings.Contains(message, strings.ToLower(m)) {
+				return kind.err
+			}
+		}
+	}
+
+	for _, kind := range rcErrorKinds {
+		for _, s := range kind.status {
+			if e.Status == s {
+				return kind.err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *RCError) Is(target error) bool {
+	kind := e.Kind()
+	return kind != nil && kind == target
+}
+
+// statusFromError translates the errors of the driver and rclone to gRPC status errors.
+// Every RPC returns its errors through it, unless an error deserves a more specific message.
+func statusFromError(err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	return status.Error(codeFromError(err), err.Error())
+}
+
+func codeFromError(err error) codes.Code {
+
+	var retryable *RetryableError
+	var rcErr *RCError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.As(err, &retryable):
+		return codes.Unavailable
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrMountNotFound), errors.Is(err, ErrVfsNotFound):
+		return codes.NotFound
+	// a volume of the same name exists, but differs from the request, csi-sanity expects AlreadyExists
+	case errors.Is(err, ErrMetaWrongID), errors.Is(err, ErrMetaWrongCapacity), errors.Is(err, ErrMetaWrongSource):
+		return codes.AlreadyExists
+	case errors.Is(err, ErrRemoteNotFound), errors.Is(err, ErrInvalidOption):
+		return codes.InvalidArgument
+	case errors.Is(err, ErrPermissionDenied):
+		return codes.PermissionDenied
+	case errors.Is(err, ErrNoSpace):
+		return codes.ResourceExhausted
+	case errors.Is(err, ErrAboutNotSupported), errors.Is(err, ErrMethodNotFound):
+		return codes.Unimplemented
+	case errors.As(err, &rcErr):
+		switch rcErr.Status {
+		case http.StatusBadRequest:
+			return codes.InvalidArgument
+		case http.StatusConflict:
+			return codes.AlreadyExists
+		case http.StatusTooManyRequests:
+			return codes.ResourceExhausted
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return codes.Unavailable
+		}
+	}
+
+	return codes.Internal
+}
@@ -0,0 +1,8 @@
+package csirclone
+
+// helpers exported for the tests of csirclone_test
+var (
+	RemoteFs      = remoteFs
+	RedactSecrets = redactSecrets
+	EnforceQuota  = (*NodeServer).enforceQuota
+)
@@ -0,0 +1,865 @@
+package csirclone_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/cornfeedhobo/csi-driver-rclone/internal/csirclone"
+	"github.com/cornfeedhobo/csi-driver-rclone/internal/rcfake"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/rclone/rclone/fs/rc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+var _ = Describe("Driver with a fake rcd", Ordered, func() {
+
+	const endpoint = "unix:///tmp/csi-fake.sock"
+
+	var (
+		driver     *Driver
+		fake       *rcfake.RC
+		conn       *grpc.ClientConn
+		controller csi.ControllerClient
+		node       csi.NodeClient
+		ctx        = context.Background()
+	)
+
+	var capability = &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	var createVolume = func(name string, parameters map[string]string) (*csi.CreateVolumeResponse, error) {
+		return controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+			Parameters:         parameters,
+		})
+	}
+
+	var cloneVolume = func(ctx context.Context, name, sourceID string) (*csi.CreateVolumeResponse, error) {
+		return controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID},
+				},
+			},
+		})
+	}
+
+	var metadata = func(id string) string {
+		b, ok := fake.ReadFile("fake:volumes/" + id + "/" + MetadataFilename)
+		Expect(ok).To(BeTrue())
+		return string(b)
+	}
+
+	var calls = func(method string) (n int) {
+		for _, call := range fake.Calls() {
+			if call == method {
+				n++
+			}
+		}
+		return
+	}
+
+	var stage = func(name string) error {
+		resp, err := createVolume(name, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          resp.GetVolume().GetVolumeId(),
+			StagingTargetPath: path.Join(GinkgoT().TempDir(), "staging"),
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+
+	BeforeAll(func() {
+		fake = rcfake.New("fake")
+
+		driver = NewDriver(&DriverOptions{
+			NodeId:     "fakeTest",
+			DriverName: "fake." + DefaultDriverName,
+			Endpoint:   endpoint,
+			Remote:     "fake:volumes",
+			MountType:  "mount2",
+			MountOpt:   map[string]string{"AllowOther": "true"},
+
+			RCRetries:      2,
+			RCRetryBackoff: time.Millisecond,
+
+			StateDir: GinkgoT().TempDir(),
+		})
+		driver.Client = fake
+		driver.Mounter = mount.NewFakeMounter(nil)
+		Expect(os.MkdirAll(driver.WorkDir, 0700)).To(Succeed())
+		driver.Start()
+
+		var err error
+		conn, err = grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		controller = csi.NewControllerClient(conn)
+		node = csi.NewNodeClient(conn)
+	})
+
+	AfterAll(func() {
+		conn.Close()
+		driver.Stop()
+		driver.Wait()
+		os.RemoveAll(driver.WorkDir)
+	})
+
+	AfterEach(func() {
+		fake.Reset()
+	})
+
+	It("writes the metadata of created volumes, with their option overrides", func() {
+		resp, err := createVolume("fake-volume", map[string]string{"vfsOpt.CacheMode": "full"})
+		Expect(err).NotTo(HaveOccurred())
+
+		id := resp.GetVolume().GetVolumeId()
+		Expect(metadata(id)).To(ContainSubstring(`"name": "fake-volume"`))
+		Expect(metadata(id)).To(ContainSubstring(`"CacheMode": "full"`))
+	})
+
+	It("reports capacity without creating missing remote roots", func() {
+		before := calls("operations/mkdir")
+
+		resp, err := controller.GetCapacity(ctx, &csi.GetCapacityRequest{
+			Parameters: map[string]string{ParameterRemote: "fake:missing"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetAvailableCapacity()).To(BeZero())
+		Expect(calls("operations/mkdir") - before).To(BeZero())
+	})
+
+	It("rejects unknown options", func() {
+		_, err := createVolume("fake-bad-option", map[string]string{"vfsOpt.CachMode": "full"})
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		Expect(err.Error()).To(ContainSubstring("did you mean 'CacheMode'"))
+	})
+
+	It("accepts options named regardless of case, as rclone names them", func() {
+		m, err := driver.NewMount(ctx, "fake-case", "/fake-case", map[string]string{
+			"vfsOpt.cachemode": "full",
+			"vfsOpt":           `{"dircachetime": "1m"}`,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.VfsOpt).To(Equal(`{"CacheMode":"full","DirCacheTime":60000000000}`))
+		Expect(m.MountOpt).To(Equal(`{"AllowOther":true}`))
+
+		_, err = driver.NewMount(ctx, "fake-case", "/fake-case", map[string]string{
+			"vfsOpt.cachemode": "full",
+			"vfsOpt.CacheMode": "off",
+		})
+		Expect(err).To(MatchError(ContainSubstring("vfs option 'CacheMode' is set more than once")))
+	})
+
+	It("fails to create volumes when rcd fails", func() {
+		fake.Fail("operations/movefile", errors.New("permission denied"))
+
+		_, err := createVolume("fake-failing", nil)
+		Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+		Expect(err.Error()).To(ContainSubstring("permission denied"))
+
+		// the failure was only injected once
+		_, err = createVolume("fake-failing", nil)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("translates the errors of rcd to gRPC status codes", func() {
+		fake.Fail("operations/movefile", errors.New("googleapi: Error 403: The user's Drive storage quota has been exceeded"))
+		_, err := createVolume("fake-full", nil)
+		Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+
+		fake.Fail("operations/movefile", errors.New("something broke"))
+		_, err = createVolume("fake-broken", nil)
+		Expect(status.Code(err)).To(Equal(codes.Internal))
+	})
+
+	It("reports volumes as abnormal when their metadata can't be read", func() {
+		resp, err := createVolume("fake-abnormal", nil)
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+
+		fake.Fail("operations/copyfile")
+
+		get, err := controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: id})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get.GetStatus().GetVolumeCondition().GetAbnormal()).To(BeTrue())
+		Expect(get.GetStatus().GetVolumeCondition().GetMessage()).To(ContainSubstring("injected failure"))
+	})
+
+	It("deletes volumes", func() {
+		resp, err := createVolume("fake-deleted", nil)
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+
+		_, err = controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, ok := fake.ReadFile("fake:volumes/" + id + "/" + MetadataFilename)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("clones volumes with rcd copy jobs", func() {
+		source, err := createVolume("fake-clone-source", nil)
+		Expect(err).NotTo(HaveOccurred())
+		sourceID := source.GetVolume().GetVolumeId()
+		fake.WriteFile("fake:volumes/"+sourceID+"/data", []byte("cloned"))
+
+		clone, err := cloneVolume(ctx, "fake-clone", sourceID)
+		Expect(err).NotTo(HaveOccurred())
+
+		b, ok := fake.ReadFile("fake:volumes/" + clone.GetVolume().GetVolumeId() + "/data")
+		Expect(ok).To(BeTrue())
+		Expect(string(b)).To(Equal("cloned"))
+		Expect(calls("job/status")).To(BeNumerically(">", 0))
+	})
+
+	It("waits on the running copy job when a clone is retried", func() {
+		source, err := createVolume("fake-slow-source", nil)
+		Expect(err).NotTo(HaveOccurred())
+		sourceID := source.GetVolume().GetVolumeId()
+		fake.WriteFile("fake:volumes/"+sourceID+"/data", []byte("slow"))
+
+		fake.HoldJobs()
+		before := calls("sync/copy")
+
+		for i := 0; i < 2; i++ {
+			timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			_, err = cloneVolume(timeoutCtx, "fake-slow-clone", sourceID)
+			cancel()
+			Expect(status.Code(err)).To(Equal(codes.DeadlineExceeded))
+		}
+		Expect(calls("sync/copy") - before).To(Equal(1))
+
+		fake.ReleaseJobs()
+
+		clone, err := cloneVolume(ctx, "fake-slow-clone", sourceID)
+		Expect(err).NotTo(HaveOccurred())
+		_, ok := fake.ReadFile("fake:volumes/" + clone.GetVolume().GetVolumeId() + "/data")
+		Expect(ok).To(BeTrue())
+	})
+
+	It("lists and mounts volumes of the StorageClass remotes", func() {
+		resp, err := createVolume("fake-other-remote", map[string]string{ParameterRemote: "fake:"})
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+		remote, name := path.Split(id)
+		Expect(remote).To(Equal("fake:/"))
+
+		_, ok := fake.ReadFile("fake:" + name + "/" + MetadataFilename)
+		Expect(ok).To(BeTrue())
+
+		list, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		Expect(err).NotTo(HaveOccurred())
+		var ids []string
+		for _, entry := range list.GetEntries() {
+			ids = append(ids, entry.GetVolume().GetVolumeId())
+		}
+		Expect(ids).To(ContainElement(id))
+
+		stagingPath := path.Join(GinkgoT().TempDir(), "staging")
+		_, err = node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  capability,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.Mounts()).To(ContainElement(HaveField("Fs", "fake:"+name)))
+
+		_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: id, StagingTargetPath: stagingPath})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports volumes conflicting with their metadata as existing", func() {
+		resp, err := createVolume("fake-conflict", nil)
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+
+		fake.WriteFile("fake:volumes/"+id+"/"+MetadataFilename, []byte(`{"id": "other", "capacity": 1048576}`))
+
+		_, err = createVolume("fake-conflict", nil)
+		Expect(status.Code(err)).To(Equal(codes.AlreadyExists))
+	})
+
+	It("lists snapshots of the StorageClass remotes", func() {
+		resp, err := createVolume("fake-other-snapshotted", map[string]string{ParameterRemote: "fake:"})
+		Expect(err).NotTo(HaveOccurred())
+
+		snapshot, err := controller.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           "fake-other-snapshot",
+			SourceVolumeId: resp.GetVolume().GetVolumeId(),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		list, err := controller.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+		Expect(err).NotTo(HaveOccurred())
+		var ids []string
+		for _, entry := range list.GetEntries() {
+			ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+		}
+		Expect(ids).To(ContainElement(snapshot.GetSnapshot().GetSnapshotId()))
+	})
+
+	It("mounts staged volumes with the merged options", func() {
+		resp, err := createVolume("fake-staged", map[string]string{"mountOpt.AttrTimeout": "5s"})
+		Expect(err).NotTo(HaveOccurred())
+
+		stagingPath := path.Join(GinkgoT().TempDir(), "staging")
+
+		_, err = node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          resp.GetVolume().GetVolumeId(),
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  capability,
+			VolumeContext:     resp.GetVolume().GetVolumeContext(),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		mounts := fake.Mounts()
+		Expect(mounts).To(HaveLen(1))
+		Expect(mounts[0].MountPoint).To(Equal(stagingPath))
+		Expect(mounts[0].MountOpt).To(Equal(`{"AllowOther":true,"AttrTimeout":5000000000}`))
+
+		_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          resp.GetVolume().GetVolumeId(),
+			StagingTargetPath: stagingPath,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.Mounts()).To(BeEmpty())
+	})
+
+	It("publishes staged volumes only once their staging path is mounted", func() {
+		resp, err := createVolume("fake-published", nil)
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+
+		stagingPath := path.Join(GinkgoT().TempDir(), "staging")
+		targetPath := path.Join(GinkgoT().TempDir(), "target")
+		publish := func() error {
+			_, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+				VolumeId:          id,
+				StagingTargetPath: stagingPath,
+				TargetPath:        targetPath,
+				VolumeCapability:  capability,
+			})
+			return err
+		}
+
+		Expect(status.Code(publish())).To(Equal(codes.FailedPrecondition))
+
+		mounter := driver.Mounter.(*mount.FakeMounter)
+		Expect(os.MkdirAll(stagingPath, 0o750)).To(Succeed())
+		Expect(mounter.Mount("fake:volumes/"+id, stagingPath, "fuse.rclone", nil)).To(Succeed())
+
+		Expect(publish()).To(Succeed())
+		Expect(mounter.IsLikelyNotMountPoint(targetPath)).To(BeFalse())
+	})
+
+	It("fails to stage volumes when rcd can't mount them", func() {
+		resp, err := createVolume("fake-unmountable", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		fake.Fail("mount/mount", errors.New("fuse: device not found"))
+
+		_, err = node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          resp.GetVolume().GetVolumeId(),
+			StagingTargetPath: path.Join(GinkgoT().TempDir(), "staging"),
+			VolumeCapability:  capability,
+		})
+		Expect(status.Code(err)).To(Equal(codes.Internal))
+		Expect(fake.Mounts()).To(BeEmpty())
+	})
+
+	It("doesn't time out long-running calls", func() {
+		resp, err := createVolume("fake-slow", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		timeout := driver.RCTimeout
+		driver.RCTimeout = 20 * time.Millisecond
+		driver.Client = &slowRC{RCClient: fake, delay: 100 * time.Millisecond}
+		DeferCleanup(func() {
+			driver.RCTimeout = timeout
+			driver.Client = fake
+		})
+
+		_, _, err = driver.GetVolumeUsage(ctx, resp.GetVolume().GetVolumeId())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = driver.RC(ctx, "operations/about", rc.Params{"fs": "fake:volumes"})
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("mounts inline volumes of allowed remotes only, read-only unless allowed", func() {
+		publish := func(id string, attributes map[string]string) (string, error) {
+			attributes[ContextEphemeral] = "true"
+			targetPath := path.Join(GinkgoT().TempDir(), "target")
+			_, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+				VolumeId:         id,
+				TargetPath:       targetPath,
+				VolumeCapability: capability,
+				VolumeContext:    attributes,
+			})
+			return targetPath, err
+		}
+		vfsOpt := func(targetPath string) string {
+			for _, m := range fake.Mounts() {
+				if m.MountPoint == targetPath {
+					return m.VfsOpt
+				}
+			}
+			return ""
+		}
+
+		_, err := publish("inline-disabled", map[string]string{ParameterRemote: "datasets:"})
+		Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+
+		driver.InlineAllow = []string{"datasets:", "fake:"}
+		DeferCleanup(func() {
+			driver.InlineAllow = nil
+			driver.InlineWritable = false
+		})
+
+		for _, attributes := range []map[string]string{
+			{ParameterRemote: "other:"},
+			{ParameterRemote: "datasets:", ParameterPath: "../../etc"},
+			{ParameterRemote: "datasets:", ParameterPath: "../x"},
+			{ParameterRemote: "datasets:../x"},
+			{ParameterRemote: "datasets:imagenet/../../x"},
+			{ParameterRemote: "datasets:/etc"},
+			{ParameterRemote: "datasetsx:"},
+			{ParameterRemote: "fake:"},
+			{ParameterRemote: "fake:volumes"},
+			{ParameterRemote: "fake:volumes", ParameterPath: "pvc-0"},
+			{},
+		} {
+			_, err := publish("inline-refused", attributes)
+			Expect(status.Code(err)).To(Equal(codes.PermissionDenied), "attributes %v", attributes)
+		}
+		Expect(fake.Mounts()).NotTo(ContainElement(HaveField("Fs", ContainSubstring("etc"))))
+
+		_, err = node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         "inline-secrets",
+			TargetPath:       path.Join(GinkgoT().TempDir(), "target"),
+			VolumeCapability: capability,
+			VolumeContext:    map[string]string{ContextEphemeral: "true", ParameterRemote: "datasets:"},
+			Secrets:          map[string]string{"endpoint": "https://attacker.example"},
+		})
+		Expect(status.Code(err)).To(Equal(codes.PermissionDenied))
+
+		targetPath, err := publish("inline-ro", map[string]string{ParameterRemote: "datasets:", ParameterPath: "imagenet"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vfsOpt(targetPath)).To(ContainSubstring(`"ReadOnly":true`))
+
+		driver.InlineWritable = true
+		targetPath, err = publish("inline-rw", map[string]string{ParameterRemote: "datasets:imagenet"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vfsOpt(targetPath)).NotTo(ContainSubstring(`"ReadOnly"`))
+	})
+
+	It("restricts mount type overrides as options", func() {
+		driver.OptOverrideDeny = []string{ParameterMountType}
+		DeferCleanup(func() { driver.OptOverrideDeny = nil })
+
+		parameters := map[string]string{ParameterMountType: "cmount"}
+
+		_, err := createVolume("fake-mount-type", parameters)
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+
+		_, err = driver.NewMount(ctx, "fake-mount-type", "/mnt/fake", parameters)
+		Expect(err).To(MatchError(ErrInvalidOption))
+
+		driver.OptOverrideDeny = nil
+		m, err := driver.NewMount(ctx, "fake-mount-type", "/mnt/fake", parameters)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.MountType).To(Equal("cmount"))
+	})
+
+	It("computes volume usage without writing the metadata", func() {
+		resp, err := createVolume("fake-usage", nil)
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+
+		fake.WriteFile("fake:volumes/"+id+"/data", []byte("usage"))
+		metadata, ok := fake.ReadFile("fake:volumes/" + id + "/" + MetadataFilename)
+		Expect(ok).To(BeTrue())
+		before := calls("operations/movefile")
+
+		v, used, err := driver.GetVolumeUsage(ctx, id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v.ID).To(Equal(id))
+		Expect(used).To(BeNumerically(">=", len("usage")))
+
+		Expect(calls("operations/movefile")).To(Equal(before))
+		after, _ := fake.ReadFile("fake:volumes/" + id + "/" + MetadataFilename)
+		Expect(after).To(Equal(metadata))
+	})
+
+	It("doesn't remount volumes over quota while they are published", func() {
+		driver.QuotaMode = QuotaModeReadOnly
+		DeferCleanup(func() { driver.QuotaMode = "" })
+
+		resp, err := createVolume("fake-quota", nil)
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+
+		ns := NewNodeServer(driver)
+		state, err := NewStateStore(driver.StateDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		stagingPath := path.Join(GinkgoT().TempDir(), "staging")
+		targetPath := path.Join(GinkgoT().TempDir(), "target")
+		stageRequest := &csi.NodeStageVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  capability,
+		}
+		_, err = ns.NodeStageVolume(ctx, stageRequest)
+		Expect(err).NotTo(HaveOccurred())
+		mounter := driver.Mounter.(*mount.FakeMounter)
+		Expect(mounter.Mount("fake:volumes/"+id, stagingPath, "fuse.rclone", nil)).To(Succeed())
+		_, err = ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  capability,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		fake.WriteFile("fake:volumes/"+id+"/data", make([]byte, 2*1024*1024))
+		vfsOpt := func() string {
+			for _, m := range fake.Mounts() {
+				if m.MountPoint == stagingPath {
+					return m.VfsOpt
+				}
+			}
+			return ""
+		}
+		enforce := func() *Mount {
+			m, err := state.Get(id)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(EnforceQuota(ns, ctx, m)).To(Succeed())
+			m, err = state.Get(id)
+			Expect(err).NotTo(HaveOccurred())
+			return m
+		}
+
+		before := calls("mount/unmount")
+		m := enforce()
+		Expect(m.QuotaExceeded).To(BeTrue())
+		Expect(m.QuotaReadOnly).To(BeFalse())
+		Expect(calls("mount/unmount")).To(Equal(before))
+		Expect(vfsOpt()).NotTo(ContainSubstring("ReadOnly"))
+
+		_, err = ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: id, TargetPath: targetPath})
+		Expect(err).NotTo(HaveOccurred())
+		// the fake rcd doesn't unmount the fake mounter
+		Expect(mounter.Unmount(stagingPath)).To(Succeed())
+
+		m = enforce()
+		Expect(m.QuotaReadOnly).To(BeTrue())
+		Expect(vfsOpt()).To(ContainSubstring(`"ReadOnly":true`))
+
+		_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: id, StagingTargetPath: stagingPath})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = ns.NodeStageVolume(ctx, stageRequest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(vfsOpt()).To(ContainSubstring(`"ReadOnly":true`))
+	})
+
+	It("refuses to publish staged volumes with another fsGroup or mount options", func() {
+		resp, err := createVolume("fake-fsgroup", nil)
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+
+		withMount := func(group string, flags ...string) *csi.VolumeCapability {
+			return &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{
+					MountFlags:       flags,
+					VolumeMountGroup: group,
+				}},
+				AccessMode: capability.GetAccessMode(),
+			}
+		}
+
+		stagingPath := path.Join(GinkgoT().TempDir(), "staging")
+		_, err = node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  withMount("1000"),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		mounter := driver.Mounter.(*mount.FakeMounter)
+		Expect(mounter.Mount("fake:volumes/"+id, stagingPath, "fuse.rclone", nil)).To(Succeed())
+
+		publish := func(c *csi.VolumeCapability) error {
+			_, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+				VolumeId:          id,
+				StagingTargetPath: stagingPath,
+				TargetPath:        path.Join(GinkgoT().TempDir(), "target"),
+				VolumeCapability:  c,
+			})
+			return err
+		}
+
+		Expect(publish(withMount("1000"))).To(Succeed())
+		Expect(publish(withMount(""))).To(Succeed())
+
+		err = publish(withMount("2000"))
+		Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		Expect(err.Error()).To(ContainSubstring("GID=2000 (staged with 1000)"))
+
+		Expect(status.Code(publish(withMount("1000", "uid=5")))).To(Equal(codes.FailedPrecondition))
+	})
+
+	It("keeps the staging mount when rcd fails to unmount it", func() {
+		resp, err := createVolume("fake-busy", nil)
+		Expect(err).NotTo(HaveOccurred())
+		id := resp.GetVolume().GetVolumeId()
+
+		stagingPath := path.Join(GinkgoT().TempDir(), "staging")
+		Expect(os.MkdirAll(stagingPath, 0o750)).To(Succeed())
+		mounter := driver.Mounter.(*mount.FakeMounter)
+		Expect(mounter.Mount("fake:volumes/"+id, stagingPath, "fuse.rclone", nil)).To(Succeed())
+
+		fake.Fail("mount/unmount", errors.New("failed to umount FUSE fs: device or resource busy"))
+
+		_, err = node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: stagingPath,
+		})
+		Expect(status.Code(err)).To(Equal(codes.Internal))
+		Expect(err.Error()).To(ContainSubstring("device or resource busy"))
+		Expect(err.Error()).NotTo(ContainSubstring("lazily"))
+		Expect(mounter.IsLikelyNotMountPoint(stagingPath)).To(BeFalse())
+	})
+
+	It("retries idempotent calls failing temporarily", func() {
+		resp, err := createVolume("fake-retried", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		reset := &RetryableError{Err: errors.New("connection reset by peer")}
+		fake.Fail("operations/copyfile", reset, reset)
+		before := calls("operations/copyfile")
+
+		get, err := controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get.GetStatus().GetVolumeCondition().GetAbnormal()).To(BeFalse())
+		Expect(calls("operations/copyfile") - before).To(Equal(3))
+	})
+
+	It("gives up once the retries are exhausted", func() {
+		resp, err := createVolume("fake-exhausted", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		reset := &RetryableError{Err: errors.New("connection reset by peer")}
+		fake.Fail("operations/copyfile", reset, reset, reset)
+
+		get, err := controller.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get.GetStatus().GetVolumeCondition().GetAbnormal()).To(BeTrue())
+	})
+
+	It("doesn't repeat mounts that may have reached rcd", func() {
+		fake.Fail("mount/mount", &RetryableError{Err: errors.New("connection reset by peer")})
+		before := calls("mount/mount")
+
+		Expect(status.Code(stage("fake-mount-reset"))).To(Equal(codes.Unavailable))
+		Expect(calls("mount/mount") - before).To(Equal(1))
+	})
+
+	It("retries mounts that never reached rcd", func() {
+		fake.Fail("mount/mount", &RetryableError{Err: errors.New("connection refused"), NotSent: true})
+		before := calls("mount/mount")
+
+		Expect(stage("fake-mount-refused")).To(Succeed())
+		Expect(calls("mount/mount") - before).To(Equal(2))
+	})
+
+	It("refuses to reload changes of the driver remote", func() {
+		opts := driver.DriverOptions.Clone()
+		opts.Remote = "fake:elsewhere"
+		opts.VfsOpt = map[string]string{"CacheMode": "full"}
+
+		Expect(driver.Reload(ctx, opts)).To(MatchError(ContainSubstring("require a restart")))
+		Expect(driver.DefaultRemote()).To(Equal("fake:volumes"))
+		Expect(driver.GetVfsOpt(ctx)).NotTo(ContainSubstring(`"CacheMode":"full"`))
+	})
+
+	It("keeps the previous config when the rclone config can't be applied", func() {
+		opts := driver.DriverOptions.Clone()
+		opts.Username = "reloaded"
+		opts.Password = "reloaded"
+		opts.VfsOpt = map[string]string{"CacheMode": "full"}
+		opts.RcloneConfig = "[extra]\ntype = memory\n"
+
+		fake.Fail("config/create", errors.New("failed to create remote"))
+
+		Expect(driver.Reload(ctx, opts)).To(MatchError(ContainSubstring("failed to create remote")))
+		Expect(driver.Username).To(BeEmpty())
+		Expect(driver.Password).To(BeEmpty())
+		Expect(driver.RcloneConfig).To(BeEmpty())
+		Expect(driver.GetVfsOpt(ctx)).NotTo(ContainSubstring(`"CacheMode":"full"`))
+
+		Expect(driver.Reload(ctx, opts)).To(Succeed())
+		Expect(driver.Password).To(Equal("reloaded"))
+		Expect(driver.GetVfsOpt(ctx)).To(ContainSubstring(`"CacheMode":"full"`))
+	})
+})
+
+// optionsInfo is an excerpt of the options/info answer of rcd 1.67
+const optionsInfo = `{
+	"main": [
+		{"Name": "transfers", "FieldName": "Transfers", "Help": "Number of file transfers to run in parallel", "Default": 4, "Value": null, "Hide": 0, "Required": false, "IsPassword": false, "NoPrefix": false, "Advanced": false, "Exclusive": false, "Sensitive": false, "DefaultStr": "4", "ValueStr": "4", "Type": "int"}
+	],
+	"mount": [
+		{"Name": "allow_other", "FieldName": "AllowOther", "Help": "Allow access to other users (not supported on Windows)", "Default": false, "Value": null, "Hide": 0, "Required": false, "IsPassword": false, "NoPrefix": true, "Advanced": false, "Exclusive": false, "Sensitive": false, "DefaultStr": "false", "ValueStr": "false", "Type": "bool"},
+		{"Name": "attr_timeout", "FieldName": "AttrTimeout", "Help": "Time for which file/directory attributes are cached", "Default": 1000000000, "Value": null, "Hide": 0, "Required": false, "IsPassword": false, "NoPrefix": true, "Advanced": false, "Exclusive": false, "Sensitive": false, "DefaultStr": "1s", "ValueStr": "1s", "Type": "Duration"},
+		{"Name": "volname", "FieldName": "VolumeName", "Help": "Set the volume name (supported on Windows and OSX only)", "Default": "", "Value": null, "Hide": 0, "Required": false, "IsPassword": false, "NoPrefix": true, "Advanced": false, "Exclusive": false, "Sensitive": false, "DefaultStr": "", "ValueStr": "", "Type": "string"}
+	],
+	"vfs": [
+		{"Name": "vfs_cache_mode", "FieldName": "CacheMode", "Help": "Cache mode off|minimal|writes|full", "Default": "off", "Value": null, "Hide": 0, "Required": false, "IsPassword": false, "NoPrefix": true, "Advanced": false, "Exclusive": false, "Sensitive": false, "DefaultStr": "off", "ValueStr": "off", "Type": "CacheMode"},
+		{"Name": "vfs_cache_max_size", "FieldName": "CacheMaxSize", "Help": "Max total size of objects in the cache", "Default": -1, "Value": null, "Hide": 0, "Required": false, "IsPassword": false, "NoPrefix": true, "Advanced": false, "Exclusive": false, "Sensitive": false, "DefaultStr": "off", "ValueStr": "off", "Type": "SizeSuffix"},
+		{"Name": "umask", "FieldName": "Umask", "Help": "Override the permission bits set by the filesystem (not supported on Windows)", "Default": 18, "Value": null, "Hide": 0, "Required": false, "IsPassword": false, "NoPrefix": true, "Advanced": false, "Exclusive": false, "Sensitive": false, "DefaultStr": "22", "ValueStr": "22", "Type": "FileMode"},
+		{"Name": "vfs_links", "FieldName": "Links", "Help": "Translate symlinks to/from regular files with a '.rclonelink' extension for the VFS", "Default": false, "Value": null, "Hide": 0, "Required": false, "IsPassword": false, "NoPrefix": true, "Advanced": false, "Exclusive": false, "Sensitive": false, "DefaultStr": "false", "ValueStr": "false", "Type": "bool"}
+	]
+}`
+
+var _ = Describe("Driver with an rcd providing options/info", func() {
+
+	var (
+		driver *Driver
+		fake   *rcfake.RC
+		ctx    = context.Background()
+	)
+
+	BeforeEach(func() {
+		var options rc.Params
+		Expect(json.Unmarshal([]byte(optionsInfo), &options)).To(Succeed())
+
+		fake = rcfake.New("fake")
+		fake.SetOptions(options)
+
+		driver = NewDriver(&DriverOptions{
+			NodeId:     "fakeTest",
+			DriverName: "fake." + DefaultDriverName,
+			Remote:     "fake:volumes",
+			MountOpt:   map[string]string{"allowother": "true"},
+		})
+		driver.Client = fake
+	})
+
+	It("validates options with the schema of rcd", func() {
+		m, err := driver.NewMount(ctx, "fake-options", "/fake-options", map[string]string{
+			"mountOpt.AttrTimeout": "5s",
+			"vfsOpt.CacheMode":     "full",
+			"vfsOpt.cachemaxsize":  "1G",
+			"vfsOpt.Umask":         "0o027",
+			// unknown to the rclone linked in the driver
+			"vfsOpt.Links": "true",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.MountOpt).To(Equal(`{"AllowOther":true,"AttrTimeout":5000000000}`))
+		Expect(m.VfsOpt).To(Equal(`{"CacheMaxSize":1073741824,"CacheMode":"full","Links":true,"Umask":23}`))
+
+		err = driver.ValidateVolumeOpt(ctx, map[string]string{"mountOpt.DaemonTimeout": "1s"})
+		Expect(err).To(MatchError(ContainSubstring("unknown mount option 'DaemonTimeout', valid options are: AllowOther, AttrTimeout, VolumeName")))
+
+		err = driver.ValidateVolumeOpt(ctx, map[string]string{"vfsOpt.Link": "true"})
+		Expect(err).To(MatchError(ContainSubstring("did you mean 'Links'?")))
+
+		Expect(fake.Calls()).To(Equal([]string{"options/info"}))
+	})
+})
+
+var _ = Describe("Secrets", func() {
+
+	DescribeTable("build connection string remotes",
+		func(remote string, secrets map[string]string, expected string) {
+			ctx := WithSecrets(context.Background(), secrets)
+			Expect(RemoteFs(ctx, remote)).To(Equal(expected))
+		},
+		Entry("without secrets", "name:path", nil, "name:path"),
+		Entry("overriding a configured remote", "name:path",
+			map[string]string{"secret_access_key": "s3cr3t", "access_key_id": "id"},
+			`name,access_key_id="id",secret_access_key="s3cr3t":path`),
+		Entry("of the secret type", "name:bucket/dir",
+			map[string]string{SecretType: "s3", "access_key_id": "id"},
+			`:s3,access_key_id="id":bucket/dir`),
+		Entry("on the fly", ":s3:bucket",
+			map[string]string{"access_key_id": "id"},
+			`:s3,access_key_id="id":bucket`),
+		Entry("on the fly with parameters", `:s3,region="eu:1":bucket`,
+			map[string]string{"access_key_id": "id"},
+			`:s3,region="eu:1",access_key_id="id":bucket`),
+		Entry("at the root", "name:",
+			map[string]string{"access_key_id": "id"},
+			`name,access_key_id="id":`),
+		Entry("quoting values", "name:path",
+			map[string]string{"secret_access_key": `a"b,c:d`},
+			`name,secret_access_key="a""b,c:d":path`),
+		Entry("ignoring local paths", "/data/volumes",
+			map[string]string{"access_key_id": "id"},
+			"/data/volumes"),
+	)
+
+	DescribeTable("redact secrets from messages",
+		func(secrets map[string]string, message, expected string) {
+			ctx := WithSecrets(context.Background(), secrets)
+			Expect(RedactSecrets(ctx, message)).To(Equal(expected))
+		},
+		Entry("without secrets", nil, "failed: name:path", "failed: name:path"),
+		Entry("sensitive values",
+			map[string]string{SecretType: "s3", "secret_access_key": "s3cr3t", "access_key_id": "AKIA"},
+			`failed to create :s3,access_key_id="AKIA",secret_access_key="s3cr3t":bucket`,
+			`failed to create :s3,access_key_id="***",secret_access_key="***":bucket`),
+		Entry("quoted values",
+			map[string]string{"secret_access_key": `a"b`},
+			`:s3,secret_access_key="a""b":bucket: access denied for a"b`,
+			`:s3,secret_access_key="***":bucket: access denied for ***`),
+		Entry("keeping values that aren't sensitive",
+			map[string]string{SecretType: "s3", "region": "us-east-1", "provider": "AWS"},
+			`bucket not found in us-east-1 with provider AWS`,
+			`bucket not found in us-east-1 with provider AWS`),
+		Entry("options unknown to the backend",
+			map[string]string{SecretType: "s3", "unknown_option": "hidden"},
+			`unknown_option="hidden"`,
+			`unknown_option="***"`),
+		Entry("sensitive options of any backend without a type",
+			map[string]string{"pass": "hunter2", "region": "eu"},
+			`sftp pass="hunter2" in eu`,
+			`sftp pass="***" in eu`),
+	)
+})
+
+// slowRC delays the calls of operations/size and operations/about, until the context is done
+type slowRC struct {
+	RCClient
+	delay time.Duration
+}
+
+func (s *slowRC) Call(ctx context.Context, path string, in rc.Params) (rc.Params, error) {
+	if path == "operations/size" || path == "operations/about" {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.delay):
+		}
+	}
+	return s.RCClient.Call(ctx, path, in)
+}
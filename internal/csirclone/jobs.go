@@ -0,0 +1,125 @@
+package csirclone
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rclone/rclone/fs/rc"
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+// jobPollInterval is the delay between two job/status calls of a running job
+const jobPollInterval = time.Second
+
+// copyJob is a sync/copy running on rcd in the background
+type copyJob struct {
+	id   int64
+	done chan struct{}
+	// err is set before done is closed
+	err error
+}
+
+// runCopyJob starts sync/copy as an rcd job copying to dst, then waits for the job to finish.
+//
+// Copies take as long as the data does, longer than any RPC deadline, so the job keeps running
+// when ctx ends. Callers copying to the same dst in the meantime, like a CreateVolume retried by
+// the provisioner, wait on the running job instead of starting another copy.
+func (d *Driver) runCopyJob(ctx context.Context, dst string, in rc.Params) error {
+
+	d.jobsMu.Lock()
+	job, running := d.jobs[dst]
+	if !running {
+		job = &copyJob{done: make(chan struct{})}
+		if d.jobs == nil {
+			d.jobs = make(map[string]*copyJob)
+		}
+		d.jobs[dst] = job
+	}
+	d.jobsMu.Unlock()
+
+	if running {
+		klog.V(2).Infof("waiting on the running copy job to %s", dst)
+	} else if err := d.startCopyJob(ctx, dst, job, in); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-job.done:
+	}
+
+	return job.err
+}
+
+// startCopyJob starts sync/copy as an rcd job and polls it in the background.
+// When the job can't be started, it is removed so the next caller starts another one.
+func (d *Driver) startCopyJob(ctx context.Context, dst string, job *copyJob, in rc.Params) error {
+
+	params := in.Copy()
+	params["_async"] = true
+
+	out, err := d.RC(ctx, "sync/copy", params)
+	if err == nil {
+		job.id, err = out.GetInt64("jobid")
+	}
+	if err != nil {
+		job.err = err
+		d.finishCopyJob(dst, job)
+		return err
+	}
+
+	klog.V(2).Infof("started copy job %d to %s", job.id, dst)
+
+	// the job outlives ctx, but its errors still need the secrets redacted
+	go d.pollCopyJob(WithSecrets(context.Background(), secretsFromContext(ctx)), dst, job)
+
+	return nil
+}
+
+// finishCopyJob removes the job, releasing its waiters
+func (d *Driver) finishCopyJob(dst string, job *copyJob) {
+	d.jobsMu.Lock()
+	delete(d.jobs, dst)
+	d.jobsMu.Unlock()
+	close(job.done)
+}
+
+// pollCopyJob waits for the job to finish, independently of the callers waiting on it.
+func (d *Driver) pollCopyJob(ctx context.Context, dst string, job *copyJob) {
+
+	defer d.finishCopyJob(dst, job)
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		out, err := d.RC(ctx, "job/status", rc.Params{"jobid": job.id})
+		if err != nil {
+			// the job is lost when rcd restarts, callers will start another one
+			job.err = err
+			return
+		}
+
+		if finished, _ := out.GetBool("finished"); finished {
+			if success, _ := out.GetBool("success"); !success {
+				message, _ := out.GetString("error")
+				job.err = &RCError{
+					Path:    "sync/copy",
+					Status:  http.StatusInternalServerError,
+					Message: redactSecrets(ctx, fmt.Sprintf("job %d failed: %s", job.id, message)),
+				}
+			}
+			return
+		}
+
+		select {
+		case <-d.stop:
+			job.err = fmt.Errorf("driver stopped while waiting on job %d", job.id)
+			return
+		case <-ticker.C:
+		}
+	}
+}
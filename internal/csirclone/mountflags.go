@@ -0,0 +1,159 @@
+package csirclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mountFlagOpt maps the kubernetes mountOptions understood by the driver to rclone options
+var mountFlagOpt = map[string]struct {
+	vfs   bool
+	key   string
+	parse func(string) (interface{}, error)
+}{
+	"uid":                 {vfs: true, key: "UID", parse: parseUint},
+	"gid":                 {vfs: true, key: "GID", parse: parseUint},
+	"umask":               {vfs: true, key: "Umask", parse: parseOctal},
+	"dir-perms":           {vfs: true, key: "DirPerms", parse: parseOctal},
+	"file-perms":          {vfs: true, key: "FilePerms", parse: parseOctal},
+	"allow-other":         {key: "AllowOther", parse: parseBool},
+	"allow-root":          {key: "AllowRoot", parse: parseBool},
+	"default-permissions": {key: "DefaultPermissions", parse: parseBool},
+}
+
+// mountGroupUmask keeps files writable by the group given as volume_mount_group
+const mountGroupUmask = 0o002
+
+// parseMountFlags returns the rclone mount and vfs options set by kubernetes mountOptions,
+// e.g. "uid=1000", "umask=022" or "allow_other". Flags are accepted with dashes or underscores.
+// The volume mount group, from the pod fsGroup, sets the GID and a group writable umask unless set by flags.
+func parseMountFlags(flags []string, volumeMountGroup string) (mountOpt, vfsOpt map[string]interface{}, err error) {
+
+	mountOpt = map[string]interface{}{}
+	vfsOpt = map[string]interface{}{}
+
+	for _, flag := range flags {
+		name, value, found := strings.Cut(strings.TrimSpace(flag), "=")
+		name = strings.ReplaceAll(name, "_", "-")
+
+		f, ok := mountFlagOpt[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported mount option '%s'", flag)
+		}
+		if !found {
+			value = "true"
+		}
+
+		v, err := f.parse(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid mount option '%s': %w", flag, err)
+		}
+
+		if f.vfs {
+			vfsOpt[f.key] = v
+		} else {
+			mountOpt[f.key] = v
+		}
+	}
+
+	if volumeMountGroup != "" {
+		gid, err := parseUint(volumeMountGroup)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid volume mount group '%s': %w", volumeMountGroup, err)
+		}
+		vfsOpt["GID"] = gid
+		if _, ok := vfsOpt["Umask"]; !ok {
+			vfsOpt["Umask"] = mountGroupUmask
+		}
+	}
+
+	return mountOpt, vfsOpt, nil
+}
+
+// applyMountFlags sets the options of the mount from kubernetes mountOptions and the volume mount group
+func applyMountFlags(m *Mount, flags []string, volumeMountGroup string) error {
+
+	mountOpt, vfsOpt, err := parseMountFlags(flags, volumeMountGroup)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range mountOpt {
+		if m.MountOpt, err = setOpt(m.MountOpt, key, value); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range vfsOpt {
+		if m.VfsOpt, err = setOpt(m.VfsOpt, key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// conflictingMountFlags returns the options set by mountOptions and the volume mount group
+// that differ from those of the staged mount, e.g. "GID=2000 (staged with 1000)".
+// Target paths are bind mounts of the staged mount, so they can't change its options.
+func conflictingMountFlags(m *Mount, flags []string, volumeMountGroup string) ([]string, error) {
+
+	mountOpt, vfsOpt, err := parseMountFlags(flags, volumeMountGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+
+	for _, block := range []struct {
+		staged string
+		opt    map[string]interface{}
+	}{
+		{m.MountOpt, mountOpt},
+		{m.VfsOpt, vfsOpt},
+	} {
+		stagedOpt := map[string]interface{}{}
+		if block.staged != "" {
+			if err := json.Unmarshal([]byte(block.staged), &stagedOpt); err != nil {
+				return nil, fmt.Errorf("error parsing staged options: %w", err)
+			}
+		}
+		for key, value := range block.opt {
+			// compare the values as found in json, where numbers may also be strings
+			b, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			var want interface{}
+			if err := json.Unmarshal(b, &want); err != nil {
+				return nil, err
+			}
+			got, ok := stagedOpt[key]
+			switch {
+			case !ok:
+				conflicts = append(conflicts, fmt.Sprintf("%s=%v (staged without it)", key, want))
+			case fmt.Sprint(got) != fmt.Sprint(want):
+				conflicts = append(conflicts, fmt.Sprintf("%s=%v (staged with %v)", key, want, got))
+			}
+		}
+	}
+
+	sort.Strings(conflicts)
+
+	return conflicts, nil
+}
+
+func parseUint(s string) (interface{}, error) {
+	return strconv.ParseUint(s, 10, 32)
+}
+
+func parseOctal(s string) (interface{}, error) {
+	return strconv.ParseUint(s, 8, 32)
+}
+
+func parseBool(s string) (interface{}, error) {
+	return strconv.ParseBool(s)
+}
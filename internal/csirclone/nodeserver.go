@@ -5,16 +5,25 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/cornfeedhobo/csi-driver-rclone/internal/csicommon"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
 )
 
+// forceUnmountTimeout is how long a regular unmount may take before it is forced
+const forceUnmountTimeout = 30 * time.Second
+
 // NodeServer is responsible for managing the mounts and status of each node.
 type NodeServer struct {
 	*csicommon.NodeServer
@@ -27,6 +36,15 @@ type NodeServer struct {
 	// A map storing all volumes with ongoing operations so that additional operations
 	// for that same volume (as defined by VolumeID) return an Aborted error
 	vl *VolumeLocks
+
+	// state records the mounts of the node, nil when disabled
+	state *StateStore
+
+	// secrets of staged volumes, kept in memory only, to restore their mounts
+	secrets sync.Map
+
+	// overQuota holds the IDs of the volumes found over their capacity, kept after they are unstaged
+	overQuota sync.Map
 }
 
 // NewNodeServer returns a working node server.
@@ -39,10 +57,25 @@ func NewNodeServer(d *Driver) *NodeServer {
 		vl:         NewVolumeLocks(),
 	}
 
+	if d.Mounter != nil {
+		ns.mounter = d.Mounter
+	}
+
+	if d.StateDir != "" {
+		state, err := NewStateStore(d.StateDir)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		ns.state = state
+	}
+
 	ns.SetCapabilities([]csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
 	})
 
 	return ns
@@ -66,6 +99,8 @@ func (ns *NodeServer) SetCapabilities(caps []csi.NodeServiceCapability_RPC_Type)
 // NodeExpandVolume node expand volume
 func (ns *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
 	id := req.GetVolumeId()
 	if id == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -73,7 +108,7 @@ func (ns *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 
 	exist, err := ns.driver.IsVolume(ctx, id)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 	if !exist {
 		return nil, status.Error(codes.NotFound, "specified volume does not exist")
@@ -88,7 +123,7 @@ func (ns *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		if errors.Is(err, ErrNotFound) {
 			return nil, status.Error(codes.NotFound, "specified volume does not exist")
 		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	return &csi.NodeExpandVolumeResponse{
@@ -123,20 +158,218 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
 	}
 
-	info, err := os.Stat(path)
-	if err != nil {
+	if _, err := os.Lstat(path); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return nil, status.Error(codes.NotFound, err.Error())
 		}
 		return nil, status.Errorf(codes.Internal, "error getting stat of %s: %s", path, err)
 	}
 
+	condition := ns.volumeCondition(ctx, id, path)
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		if condition.GetAbnormal() {
+			// a broken mount has no usage to report, but its condition explains why
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "error getting statfs of %s: %s", path, err)
+	}
+
+	usage := []*csi.VolumeUsage{{
+		Unit:      csi.VolumeUsage_BYTES,
+		Total:     int64(st.Blocks) * int64(st.Bsize),
+		Available: int64(st.Bavail) * int64(st.Bsize),
+		Used:      (int64(st.Blocks) - int64(st.Bfree)) * int64(st.Bsize),
+	}}
+
+	// backends without a notion of inodes report none
+	if st.Files > 0 {
+		usage = append(usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(st.Files),
+			Available: int64(st.Ffree),
+			Used:      int64(st.Files) - int64(st.Ffree),
+		})
+	}
+
+	// the remote usage says little about a single volume, prefer its own size when known
+	if ns.driver.QuotaMode != "" {
+		m, err := ns.state.Get(id)
+		if err != nil {
+			klog.Errorf("error reading state of %s: %s", id, err)
+		}
+		if m != nil && m.Capacity > 0 {
+			usage[0] = &csi.VolumeUsage{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     m.Capacity,
+				Available: max(m.Capacity-m.Used, 0),
+				Used:      m.Used,
+			}
+		}
+		if m != nil && m.QuotaExceeded && !condition.GetAbnormal() {
+			condition = &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("volume uses %d bytes, over its capacity of %d bytes", m.Used, m.Capacity),
+			}
+		}
+	}
+
 	return &csi.NodeGetVolumeStatsResponse{
-		Usage:           []*csi.VolumeUsage{{Used: info.Size()}},
-		VolumeCondition: &csi.VolumeCondition{Message: "healthy"},
+		Usage:           usage,
+		VolumeCondition: condition,
 	}, nil
 }
 
+// volumeCondition reports the volume mounted at path as abnormal when the mount is stale,
+// rcd can't be reached or isn't serving it, or its VFS fails to upload.
+func (ns *NodeServer) volumeCondition(ctx context.Context, id, path string) *csi.VolumeCondition {
+
+	abnormal := func(format string, a ...interface{}) *csi.VolumeCondition {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf(format, a...)}
+	}
+
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(path)
+	switch {
+	case err != nil && mount.IsCorruptedMnt(err):
+		return abnormal("mount is stale: %s", err)
+	case err != nil:
+		return abnormal("error checking mount: %s", err)
+	case notMnt:
+		return abnormal("volume is not mounted")
+	}
+
+	mountPoints, err := ns.driver.ListMounts(ctx)
+	if err != nil {
+		return abnormal("rcd is unreachable: %s", err)
+	}
+
+	m, err := ns.state.Get(id)
+	if err != nil {
+		klog.Errorf("error reading state of %s: %s", id, err)
+	}
+	if m == nil {
+		if m, err = ns.driver.NewMount(ctx, id, path, nil); err != nil {
+			return abnormal("%s", err)
+		}
+	} else if !slices.Contains(mountPoints, m.MountPoint) {
+		return abnormal("rcd is not serving the mount at %s", m.MountPoint)
+	}
+
+	if secrets, ok := ns.secrets.Load(id); ok {
+		ctx = WithSecrets(ctx, secrets.(map[string]string))
+	}
+
+	stats, err := ns.driver.GetVfsStats(ctx, m.Fs)
+	switch {
+	case errors.Is(err, ErrVfsNotFound):
+		klog.V(4).Infof("no vfs stats for %s: %s", id, err)
+	case err != nil:
+		return abnormal("error getting vfs stats: %s", err)
+	case stats == nil:
+	case stats.ErroredFiles > 0:
+		return abnormal("%d files failed to upload, %d uploads queued", stats.ErroredFiles, stats.UploadsQueued)
+	case stats.OutOfSpace:
+		return abnormal("vfs cache is out of space")
+	}
+
+	return &csi.VolumeCondition{Message: "healthy"}
+}
+
+// NodeStageVolume mounts the volume once per node at the staging path,
+// to be shared by every target path through bind mounts.
+func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+
+	ctx = WithSecrets(ctx, req.GetSecrets())
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+
+	if !ns.vl.TryAcquire(id) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, id)
+	}
+	defer ns.vl.Release(id)
+
+	mounted, err := ns.prepareMountPoint(stagingPath)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	if mounted {
+		klog.V(2).Infof("NodeStageVolume: stagingPath already mounted: %s", stagingPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	m, err := ns.driver.NewMount(ctx, id, stagingPath, req.GetVolumeContext())
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	m.Secrets = len(req.GetSecrets()) > 0
+	m.ReadOnly = isReaderOnly(req.GetVolumeCapability())
+	_, m.QuotaExceeded = ns.overQuota.Load(id)
+
+	mnt := req.GetVolumeCapability().GetMount()
+	if err := applyMountFlags(m, mnt.GetMountFlags(), mnt.GetVolumeMountGroup()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	klog.V(2).Infof("NodeStageVolume: mounting %s", stagingPath)
+	err = ns.driver.MountVolume(ctx, m)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if m.Secrets {
+		ns.secrets.Store(id, req.GetSecrets())
+	}
+	if err := ns.state.Put(m); err != nil {
+		klog.Errorf("NodeStageVolume: error saving state of %s: %s", id, err)
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the volume from the staging path
+func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	if !ns.vl.TryAcquire(id) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, id)
+	}
+	defer ns.vl.Release(id)
+
+	klog.V(2).Infof("NodeUnstageVolume: unmounting %s", stagingPath)
+	if err := ns.unmount(ctx, stagingPath); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	ns.secrets.Delete(id)
+	if err := ns.state.Delete(id); err != nil {
+		klog.Errorf("NodeUnstageVolume: error deleting state of %s: %s", id, err)
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
 // NodePublishVolume mount the volume from staging to target path
 func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 
@@ -154,43 +387,186 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
 	}
 
-	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	// inline volumes are never staged
+	if isEphemeral(req.GetVolumeContext()) {
+		return ns.publishEphemeralVolume(ctx, req)
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	lockKey := fmt.Sprintf("%s-%s", id, targetPath)
+	if !ns.vl.TryAcquire(lockKey) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, id)
+	}
+	defer ns.vl.Release(lockKey)
+
+	mounted, err := ns.prepareMountPoint(targetPath)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			klog.V(2).Infof("NodePublishVolume: creating targetPath: %s", targetPath)
-			if err := os.MkdirAll(targetPath, 0770); err != nil {
-				return nil, status.Errorf(codes.Internal, "error making targetPath: %s", err)
-			}
-			notMnt = true
-			err = nil
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+		return nil, statusFromError(err)
+	}
+	if mounted {
+		klog.V(2).Infof("NodePublishVolume: targetPath already mounted: %s", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
 	}
-	if !notMnt {
-		klog.V(2).Infof("NodePublishVolume: targetPath already exists: %s", targetPath)
-		if _, err := os.ReadDir(targetPath); err == nil {
-			klog.V(2).Infof("NodePublishVolume: targetPath already mounted: %s", targetPath)
-			return &csi.NodePublishVolumeResponse{}, nil
-		}
 
-		klog.V(2).Infof("NodePublishVolume: targetPath %s is assumed to be a mount, but is not responding to ReadDir, attempting to unmount", targetPath)
+	// without the rclone mount, the pod would write to the disk of the node
+	if !ns.isHealthyMount(stagingPath) {
+		return nil, status.Errorf(codes.FailedPrecondition, "staging path %s is not mounted", stagingPath)
+	}
 
-		if err := ns.mounter.Unmount(targetPath); err != nil {
-			klog.V(2).Infof("NodePublishVolume: Unmount directory %s failed with %v", targetPath, err)
-			return nil, status.Error(codes.Internal, err.Error())
+	// the bind mount shares the owner and permissions of the staged mount,
+	// which pods with another fsGroup or mountOptions can't change
+	staged, err := ns.state.Get(id)
+	if err != nil {
+		klog.Errorf("NodePublishVolume: error reading state of %s: %s", id, err)
+	}
+	if staged != nil {
+		mnt := req.GetVolumeCapability().GetMount()
+		conflicts, err := conflictingMountFlags(staged, mnt.GetMountFlags(), mnt.GetVolumeMountGroup())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if len(conflicts) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume %s is staged on this node with other mount options or fsGroup: %s", id, strings.Join(conflicts, ", "))
 		}
 	}
 
-	klog.V(2).Infof("NodePublishVolume: mounting %s", targetPath)
-	err = ns.driver.MountVolume(ctx, id, targetPath, req.GetVolumeContext())
+	readOnly := req.GetReadonly() || isReaderOnly(req.GetVolumeCapability())
+
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+
+	klog.V(2).Infof("NodePublishVolume: bind mounting %s at %s with %v", stagingPath, targetPath, options)
+	if err := ns.mounter.Mount(stagingPath, targetPath, "", options); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	err = ns.state.Update(id, func(m *Mount) {
+		m.AddTargetPath(targetPath, readOnly)
+	})
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		klog.Errorf("NodePublishVolume: error saving state of %s: %s", id, err)
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// publishEphemeralVolume mounts the remote path given by the attributes of an inline volume at the target path.
+// Inline volumes have no metadata, and live as long as the pod.
+// Any pod may declare them, so only the remotes allowed by the admin are mounted, read-only unless allowed otherwise.
+func (ns *NodeServer) publishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+
+	// secrets override any option of the remote, e.g. its endpoint, sending the credentials elsewhere
+	if len(req.GetSecrets()) > 0 {
+		return nil, status.Error(codes.PermissionDenied, "inline volumes may not set secrets, the allowed remotes are mounted as configured")
+	}
+
+	id := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	volumeContext := req.GetVolumeContext()
+
+	remote := ns.driver.RemoteFromParameters(volumeContext)
+	if err := ns.driver.IsInlineAllowed(ctx, remote); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if !ns.vl.TryAcquire(id) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, id)
+	}
+	defer ns.vl.Release(id)
+
+	mounted, err := ns.prepareMountPoint(targetPath)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	if mounted {
+		klog.V(2).Infof("NodePublishVolume: targetPath already mounted: %s", targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	m, err := ns.driver.NewMount(ctx, id, targetPath, volumeContext)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	m.Fs = remote
+	m.Ephemeral = true
+	m.ReadOnly = !ns.driver.InlineWritable || req.GetReadonly() || isReaderOnly(req.GetVolumeCapability())
+
+	mnt := req.GetVolumeCapability().GetMount()
+	if err := applyMountFlags(m, mnt.GetMountFlags(), mnt.GetVolumeMountGroup()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	klog.V(2).Infof("NodePublishVolume: mounting inline volume %s from %s at %s", id, m.Fs, targetPath)
+	if err := ns.driver.MountVolume(ctx, m); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := ns.state.Put(m); err != nil {
+		klog.Errorf("NodePublishVolume: error saving state of %s: %s", id, err)
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// isEphemeral returns true for the volume context of inline volumes
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ContextEphemeral] == "true"
+}
+
+// isReaderOnly returns true for the access modes that don't allow writes
+func isReaderOnly(c *csi.VolumeCapability) bool {
+	switch c.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// prepareMountPoint creates path when missing, and unmounts anything stale found there.
+// It returns true when path is already a working mount.
+func (ns *NodeServer) prepareMountPoint(path string) (bool, error) {
+
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(path)
+	if err != nil && mount.IsCorruptedMnt(err) {
+		klog.V(2).Infof("%s is a broken mount, attempting to unmount", path)
+		return false, ns.forceUnmount(path)
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+		klog.V(2).Infof("creating mount point: %s", path)
+		if err := os.MkdirAll(path, 0770); err != nil {
+			return false, fmt.Errorf("error making mount point: %w", err)
+		}
+		return false, nil
+	}
+	if notMnt {
+		return false, nil
+	}
+
+	if _, err := os.ReadDir(path); err == nil {
+		return true, nil
+	}
+
+	klog.V(2).Infof("%s is assumed to be a mount, but is not responding to ReadDir, attempting to unmount", path)
+
+	if err := ns.mounter.Unmount(path); err != nil {
+		klog.V(2).Infof("Unmount directory %s failed with %v", path, err)
+		return false, err
+	}
+
+	return false, nil
+}
+
 // NodeUnpublishVolume unmount the volume from the target path
 func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 
@@ -211,16 +587,91 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 	defer ns.vl.Release(lockKey)
 
-	isMountPoint, err := ns.mounter.IsMountPoint(targetPath)
-	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return nil, status.Error(codes.Internal, err.Error())
+	m, err := ns.state.Get(id)
+	if err != nil {
+		klog.Errorf("NodeUnpublishVolume: error reading state of %s: %s", id, err)
 	}
 
-	if isMountPoint {
-		if err := mount.CleanupMountPoint(targetPath, ns.mounter, true); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+	klog.V(2).Infof("NodeUnpublishVolume: unmounting %s", targetPath)
+	if m != nil && m.HasTargetPath(targetPath) {
+		// bind mounts are unknown to rcd
+		err = mount.CleanupMountPoint(targetPath, ns.mounter, true)
+	} else {
+		err = ns.unmount(ctx, targetPath)
+	}
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if m != nil && m.Ephemeral && m.MountPoint == targetPath {
+		ns.secrets.Delete(id)
+		if err := ns.state.Delete(id); err != nil {
+			klog.Errorf("NodeUnpublishVolume: error deleting state of %s: %s", id, err)
 		}
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	err = ns.state.Update(id, func(m *Mount) {
+		m.RemoveTargetPath(targetPath)
+	})
+	if err != nil {
+		klog.Errorf("NodeUnpublishVolume: error saving state of %s: %s", id, err)
 	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
+
+// unmount releases the mount at path through rcd, so that rcd forgets about it,
+// then removes the directory. Mounts rcd doesn't know about, like bind mounts,
+// are unmounted by the kernel. When rcd can't be reached, the mount is forced.
+// Other errors are returned, so that kubelet retries while rcd flushes the vfs cache.
+func (ns *NodeServer) unmount(ctx context.Context, path string) error {
+
+	var retryable *RetryableError
+
+	err := ns.driver.UnmountVolume(ctx, path)
+	switch {
+	case err == nil:
+		klog.V(2).Infof("rcd unmounted %s", path)
+	case errors.Is(err, ErrMountNotFound):
+	case errors.As(err, &retryable):
+		klog.Warningf("rcd is unreachable, forcing unmount of %s: %s", path, err)
+		if err := ns.forceUnmount(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("error unmounting %s with rcd: %w", path, err)
+	}
+
+	return mount.CleanupMountPoint(path, ns.mounter, true)
+}
+
+// forceUnmount unmounts path with force, falling back to a lazy unmount,
+// which detaches the mount even when it is busy.
+func (ns *NodeServer) forceUnmount(path string) error {
+
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil
+	case err == nil && notMnt:
+		return nil
+	case err != nil && !mount.IsCorruptedMnt(err):
+		return err
+	}
+
+	if mounter, ok := ns.mounter.(mount.MounterForceUnmounter); ok {
+		err := mounter.UnmountWithForce(path, forceUnmountTimeout)
+		if err == nil {
+			return nil
+		}
+		klog.Warningf("error force unmounting %s, unmounting lazily: %s", path, err)
+	}
+
+	out, err := exec.Command("umount", "-l", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error unmounting %s lazily: %w: %s", path, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
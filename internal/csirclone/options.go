@@ -0,0 +1,428 @@
+package csirclone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/cmd/mountlib"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/rc"
+	"github.com/rclone/rclone/vfs/vfscommon"
+	"k8s.io/klog/v2"
+)
+
+// Option blocks passed to mount/mount
+const (
+	OptBlockMount = "mount"
+	OptBlockVfs   = "vfs"
+)
+
+// ErrInvalidOption is returned for unknown or malformed mount and vfs options
+var ErrInvalidOption = errors.New("invalid option")
+
+// optionSchema maps the names of the options of a block to their type, as named by rclone
+type optionSchema map[string]string
+
+// optionInfo is the subset of an option described by options/info
+type optionInfo struct {
+	Name      string
+	FieldName string
+	Type      string
+}
+
+// optionPrototypes are the go types accepted by rcd for each option type
+var optionPrototypes = map[string]reflect.Type{
+	"bool":        reflect.TypeOf(false),
+	"int":         reflect.TypeOf(int64(0)),
+	"uint32":      reflect.TypeOf(uint32(0)),
+	"FileMode":    reflect.TypeOf(os.FileMode(0)),
+	"Duration":    reflect.TypeOf(time.Duration(0)),
+	"SizeSuffix":  reflect.TypeOf(fs.SizeSuffix(0)),
+	"CacheMode":   reflect.TypeOf(vfscommon.CacheMode(0)),
+	"Tristate":    reflect.TypeOf(fs.Tristate{}),
+	"string":      reflect.TypeOf(""),
+	"stringArray": reflect.TypeOf([]string{}),
+}
+
+// optionSchemas returns the schema of each option block.
+// It is read from rcd options/info, or built from the options of the linked rclone when rcd doesn't provide it.
+func (d *Driver) optionSchemas(ctx context.Context) map[string]optionSchema {
+
+	d.schemaMu.Lock()
+	defer d.schemaMu.Unlock()
+
+	if d.schemas != nil {
+		return d.schemas
+	}
+
+	out, err := d.RC(ctx, "options/info", rc.Params{})
+	if err != nil {
+		if !errors.Is(err, ErrMethodNotFound) {
+			// try again on the next call, rcd may not be up yet
+			klog.V(2).Infof("error reading options/info, using builtin option schema: %s", err)
+			return builtinOptionSchemas()
+		}
+		klog.V(2).Infof("rcd does not provide options/info, using builtin option schema")
+		d.schemas = builtinOptionSchemas()
+		return d.schemas
+	}
+
+	schemas := map[string]optionSchema{}
+	for _, block := range []string{OptBlockMount, OptBlockVfs} {
+		var infos []optionInfo
+		if err := out.GetStruct(block, &infos); err != nil {
+			klog.Warningf("error parsing options/info %s block, using builtin option schema: %s", block, err)
+			schemas[block] = builtinOptionSchemas()[block]
+			continue
+		}
+		schema := optionSchema{}
+		for _, info := range infos {
+			name := info.FieldName
+			if name == "" {
+				name = info.Name
+			}
+			schema[name] = info.Type
+		}
+		schemas[block] = schema
+	}
+
+	d.schemas = schemas
+	return d.schemas
+}
+
+// builtinOptionSchemas describes the mount and vfs options of the linked rclone
+func builtinOptionSchemas() map[string]optionSchema {
+	return map[string]optionSchema{
+		OptBlockMount: structSchema(reflect.TypeOf(mountlib.Options{})),
+		OptBlockVfs:   structSchema(reflect.TypeOf(vfscommon.Options{})),
+	}
+}
+
+func structSchema(t reflect.Type) optionSchema {
+
+	schema := optionSchema{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		schema[field.Name] = typeName(field.Type)
+	}
+
+	return schema
+}
+
+// typeName returns the name rclone gives to the type of an option
+func typeName(t reflect.Type) string {
+
+	for name, prototype := range optionPrototypes {
+		if t == prototype {
+			return name
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint32"
+	case reflect.String:
+		return "string"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return "stringArray"
+		}
+	}
+
+	return t.Name()
+}
+
+// canonical returns the name rclone gives to an option named regardless of case,
+// or key itself when the option is unknown.
+func (s optionSchema) canonical(block, key string) string {
+
+	if _, ok := s[key]; ok {
+		return key
+	}
+
+	for name := range s {
+		if strings.EqualFold(name, key) {
+			klog.Warningf("%s option '%s' is named '%s'", block, key, name)
+			return name
+		}
+	}
+
+	return key
+}
+
+// lookup returns the name and type of an option, or an error suggesting the option that was probably meant.
+// Names differing in case only are accepted, with the name rclone gives to the option.
+func (s optionSchema) lookup(block, key string) (string, string, error) {
+
+	name := s.canonical(block, key)
+	if typ, ok := s[name]; ok {
+		return name, typ, nil
+	}
+
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if distance := levenshtein(strings.ToLower(name), strings.ToLower(key)); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+
+	if best != "" {
+		return "", "", fmt.Errorf("%w: unknown %s option '%s', did you mean '%s'?", ErrInvalidOption, block, key, best)
+	}
+
+	return "", "", fmt.Errorf("%w: unknown %s option '%s', valid options are: %s", ErrInvalidOption, block, key, strings.Join(names, ", "))
+}
+
+// coerceOpt converts the value of an option to the json rcd expects for its type.
+// Strings are parsed as on the rclone command line, other json values must decode as the type.
+func coerceOpt(typ string, value interface{}) (interface{}, error) {
+
+	s, ok := value.(string)
+	if !ok {
+		prototype, known := optionPrototypes[typ]
+		if !known {
+			return value, nil
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, reflect.New(prototype).Interface()); err != nil {
+			return nil, fmt.Errorf("expected %s: %w", typ, err)
+		}
+		return value, nil
+	}
+
+	switch typ {
+	case "bool":
+		return strconv.ParseBool(s)
+	case "int":
+		return strconv.ParseInt(s, 0, 64)
+	case "uint32":
+		return strconv.ParseUint(s, 0, 32)
+	case "FileMode":
+		return strconv.ParseUint(strings.TrimPrefix(s, "0o"), 8, 32)
+	case "Duration":
+		t, err := fs.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		return int64(t), nil
+	case "SizeSuffix":
+		var size fs.SizeSuffix
+		if err := size.Set(s); err != nil {
+			return nil, err
+		}
+		return int64(size), nil
+	case "CacheMode":
+		var mode vfscommon.CacheMode
+		if err := mode.Set(s); err != nil {
+			return nil, err
+		}
+		return mode.String(), nil
+	case "Tristate":
+		var t fs.Tristate
+		if err := t.Set(s); err != nil {
+			return nil, err
+		}
+		if !t.Valid {
+			return nil, nil
+		}
+		return t.Value, nil
+	case "stringArray":
+		if s == "" {
+			return []string{}, nil
+		}
+		return strings.Split(s, ","), nil
+	}
+
+	return s, nil
+}
+
+// normalizeOpt validates the options of a block against the option schema,
+// and returns them as the json rcd expects.
+func (d *Driver) normalizeOpt(ctx context.Context, block string, opt map[string]interface{}) (string, error) {
+
+	if len(opt) == 0 {
+		return "", nil
+	}
+
+	schema := d.optionSchemas(ctx)[block]
+
+	out := map[string]interface{}{}
+	for key, value := range opt {
+		name, typ, err := schema.lookup(block, key)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := out[name]; ok {
+			return "", fmt.Errorf("%w: %s option '%s' is set more than once", ErrInvalidOption, block, name)
+		}
+		if out[name], err = coerceOpt(typ, value); err != nil {
+			return "", fmt.Errorf("%w: %s option '%s': %s", ErrInvalidOption, block, key, err)
+		}
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// marshalOpt returns the options of a block, configured as strings, as the json rcd expects
+func (d *Driver) marshalOpt(ctx context.Context, block string, opt map[string]string) (string, error) {
+
+	in := make(map[string]interface{}, len(opt))
+	for key, value := range opt {
+		in[key] = value
+	}
+
+	return d.normalizeOpt(ctx, block, in)
+}
+
+// VolumeOpt returns the options of a block overridden by volume parameters,
+// from the json of the ParameterMountOpt or ParameterVfsOpt parameter and from prefixed parameters,
+// e.g. "vfsOpt.CacheMode". Prefixed parameters win.
+func VolumeOpt(parameters map[string]string, parameter string) (map[string]interface{}, error) {
+
+	opt := map[string]interface{}{}
+
+	if value := parameters[parameter]; value != "" {
+		if err := json.Unmarshal([]byte(value), &opt); err != nil {
+			return nil, fmt.Errorf("%w: error parsing %s: %s", ErrInvalidOption, parameter, err)
+		}
+	}
+
+	prefix := parameter + "."
+	for key, value := range parameters {
+		if name, found := strings.CutPrefix(key, prefix); found {
+			if name == "" {
+				return nil, fmt.Errorf("%w: parameter '%s' names no option", ErrInvalidOption, key)
+			}
+			opt[name] = value
+		}
+	}
+
+	return opt, nil
+}
+
+// IsOverrideAllowed returns an error unless volumes may override the option,
+// named after its parameter, e.g. "vfsOpt.CacheMode", or the mount type, named "mountType".
+// Names are compared regardless of case, as options are looked up.
+func (d *Driver) IsOverrideAllowed(name string) error {
+
+	parameter, _, _ := strings.Cut(name, ".")
+
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if strings.EqualFold(pattern, name) || strings.EqualFold(pattern, parameter+".*") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if matches(d.OptOverrideDeny) || (len(d.OptOverrideAllow) > 0 && !matches(d.OptOverrideAllow)) {
+		return fmt.Errorf("%w: volumes may not override %s", ErrInvalidOption, name)
+	}
+
+	return nil
+}
+
+// mergeOpt merges the options of a block overridden by volume parameters into the driver options, key by key,
+// and returns them as the json rcd expects.
+func (d *Driver) mergeOpt(ctx context.Context, block, parameter string, defaults map[string]string, parameters map[string]string) (string, error) {
+
+	overrides, err := VolumeOpt(parameters, parameter)
+	if err != nil {
+		return "", err
+	}
+
+	schema := d.optionSchemas(ctx)[block]
+
+	opt := make(map[string]interface{}, len(defaults)+len(overrides))
+	for key, value := range defaults {
+		opt[schema.canonical(block, key)] = value
+	}
+	overridden := make(map[string]bool, len(overrides))
+	for key, value := range overrides {
+		if err := d.IsOverrideAllowed(parameter + "." + key); err != nil {
+			return "", err
+		}
+		name := schema.canonical(block, key)
+		if overridden[name] {
+			return "", fmt.Errorf("%w: %s option '%s' is set more than once", ErrInvalidOption, block, name)
+		}
+		overridden[name] = true
+		opt[name] = value
+	}
+
+	return d.normalizeOpt(ctx, block, opt)
+}
+
+// ValidateVolumeOpt validates the mount type, mount and vfs options overridden by volume parameters
+func (d *Driver) ValidateVolumeOpt(ctx context.Context, parameters map[string]string) error {
+
+	if _, ok := parameters[ParameterMountType]; ok {
+		if err := d.IsOverrideAllowed(ParameterMountType); err != nil {
+			return err
+		}
+	}
+
+	for parameter, block := range map[string]string{
+		ParameterMountOpt: OptBlockMount,
+		ParameterVfsOpt:   OptBlockVfs,
+	} {
+		if _, err := d.mergeOpt(ctx, block, parameter, nil, parameters); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func levenshtein(a, b string) int {
+
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			prev, row[j] = row[j], min(row[j]+1, row[j-1]+1, prev+cost)
+		}
+	}
+
+	return row[len(b)]
+}
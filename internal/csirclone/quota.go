@@ -0,0 +1,148 @@
+package csirclone
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// Modes of quota enforcement
+const (
+	// QuotaModeWarn emits events while a volume is over its capacity
+	QuotaModeWarn = "warn"
+	// QuotaModeReadOnly also remounts the volume read-only, until it is back under its capacity.
+	// Volumes published to pods are only remounted once they are staged again.
+	QuotaModeReadOnly = "readonly"
+
+	// DefaultQuotaInterval is how often volume sizes are computed when no interval is configured
+	DefaultQuotaInterval = 5 * time.Minute
+)
+
+// RunQuotaEnforcer checks the size of the mounted volumes every interval, until stop is closed.
+func (ns *NodeServer) RunQuotaEnforcer(interval time.Duration, stop <-chan struct{}) {
+
+	if interval <= 0 {
+		interval = DefaultQuotaInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		mounts, err := ns.state.List()
+		if err != nil {
+			klog.Errorf("error listing state: %s", err)
+			continue
+		}
+
+		for _, m := range mounts {
+			// inline volumes have no capacity
+			if m.Ephemeral {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := ns.enforceQuota(ctx, m); err != nil {
+				klog.Errorf("error enforcing quota of %s: %s", m.VolumeID, err)
+			}
+			cancel()
+		}
+	}
+}
+
+func (ns *NodeServer) enforceQuota(ctx context.Context, m *Mount) error {
+
+	// leave volumes alone while an operation is in progress
+	if !ns.vl.TryAcquire(m.VolumeID) {
+		return nil
+	}
+	defer ns.vl.Release(m.VolumeID)
+
+	if secrets, ok := ns.secrets.Load(m.VolumeID); ok {
+		ctx = WithSecrets(ctx, secrets.(map[string]string))
+	}
+
+	v, used, err := ns.driver.GetVolumeUsage(ctx, m.VolumeID)
+	if err != nil {
+		return err
+	}
+
+	klog.V(4).Infof("volume %s uses %d of %d bytes", m.VolumeID, used, v.Capacity)
+
+	m.Capacity = v.Capacity
+	m.Used = used
+
+	exceeded := m.IsOverQuota()
+	changed := exceeded != m.QuotaExceeded
+	m.QuotaExceeded = exceeded
+	if exceeded {
+		ns.overQuota.Store(m.VolumeID, struct{}{})
+	} else {
+		ns.overQuota.Delete(m.VolumeID)
+	}
+
+	// Remounting the vfs would leave the bind mounts of running pods on a dead fuse connection,
+	// so published volumes keep their mount until they are staged again.
+	pending := false
+	if ns.driver.QuotaMode == QuotaModeReadOnly && exceeded != m.QuotaReadOnly {
+		if len(m.TargetPaths) > 0 {
+			pending = true
+		} else if err := ns.remount(ctx, m, true); err != nil {
+			return err
+		}
+	}
+
+	err = ns.state.Update(m.VolumeID, func(stored *Mount) {
+		stored.Capacity = m.Capacity
+		stored.Used = m.Used
+		stored.QuotaExceeded = m.QuotaExceeded
+		stored.QuotaReadOnly = m.QuotaReadOnly
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case exceeded:
+		ns.recordVolumeEvent(v, corev1.EventTypeWarning, "QuotaExceeded",
+			"Volume uses %d bytes, over its capacity of %d bytes", m.Used, m.Capacity)
+	case changed:
+		ns.recordVolumeEvent(v, corev1.EventTypeNormal, "QuotaRestored",
+			"Volume uses %d bytes, within its capacity of %d bytes", m.Used, m.Capacity)
+	}
+
+	if pending && changed {
+		mode := "read-write"
+		if exceeded {
+			mode = "read-only"
+		}
+		ns.recordVolumeEvent(v, corev1.EventTypeWarning, "QuotaRemountPending",
+			"Volume is in use by pods on node %s, it is remounted %s once they are restarted",
+			ns.driver.NodeId, mode)
+	}
+
+	return nil
+}
+
+// recordVolumeEvent records an event on the PersistentVolume, named after the volume
+func (ns *NodeServer) recordVolumeEvent(v *Volume, eventType, reason, messageFmt string, args ...interface{}) {
+
+	klog.Infof("%s: volume %s: "+messageFmt, append([]interface{}{reason, v.Name}, args...)...)
+
+	if ns.driver.Events == nil {
+		return
+	}
+
+	ns.driver.Events.Eventf(&corev1.ObjectReference{
+		Kind:       "PersistentVolume",
+		APIVersion: "v1",
+		Name:       v.Name,
+	}, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,203 @@
+package csirclone
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fshttp"
+	"github.com/rclone/rclone/fs/rc"
+	"github.com/rclone/rclone/fs/rc/jobs"
+	"golang.org/x/net/context"
+)
+
+// Modes of reaching rclone
+const (
+	// RcdModeSidecar calls a separate rcd over http, at the driver Address, which may be a unix socket
+	RcdModeSidecar = "sidecar"
+	// RcdModeEmbedded calls the rc methods of the rclone linked into the driver
+	RcdModeEmbedded = "embedded"
+)
+
+// RCClient calls rclone rc methods, e.g. "operations/stat" or "mount/mount".
+// Failed calls return an *RCError, whatever the transport, possibly wrapped in a RetryableError.
+type RCClient interface {
+	Call(ctx context.Context, path string, in rc.Params) (rc.Params, error)
+}
+
+// unixScheme prefixes rcd addresses that are unix sockets, e.g. "unix:///run/rclone/rc.sock"
+const unixScheme = "unix://"
+
+// httpRCClient calls rcd over http, through tcp or a unix socket
+type httpRCClient struct {
+	address string
+	// credentials returns the current rcd username and password, which may be reloaded
+	credentials func() (username, password string)
+	// client is set when rcd listens on a unix socket, otherwise the rclone http client is used
+	client *http.Client
+}
+
+// newHTTPRCClient returns a client of the rcd at address,
+// either an http(s) url or a unix socket, e.g. "unix:///run/rclone/rc.sock".
+func newHTTPRCClient(address string, credentials func() (username, password string)) *httpRCClient {
+
+	socket, ok := strings.CutPrefix(address, unixScheme)
+	if !ok {
+		return &httpRCClient{address: address, credentials: credentials}
+	}
+
+	// the host is ignored, every request is sent to the socket
+	dialer := &net.Dialer{}
+	return &httpRCClient{
+		address:     "http://unix/",
+		credentials: credentials,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// mostly copied from rclone/cmd/rc.doCall()
+func (c *httpRCClient) Call(ctx context.Context, path string, in rc.Params) (out rc.Params, err error) {
+
+	url := c.address + path
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prep request
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if username, password := c.credentials(); username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	// Do HTTP request
+	client := c.client
+	if client == nil {
+		client = fshttp.NewClient(ctx)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// connection errors are worth retrying, even for calls that can't be repeated when rcd wasn't reached
+		var opErr *net.OpError
+		return nil, &RetryableError{Err: err, NotSent: errors.As(err, &opErr) && opErr.Op == "dial"}
+	}
+	defer fs.CheckClose(resp.Body, &err)
+
+	// Read response
+	body, err := io.ReadAll(resp.Body)
+	bodyString := strings.TrimSpace(string(body))
+	if err != nil {
+		return nil, &RetryableError{Err: err}
+	}
+
+	// Parse output
+	out = make(rc.Params)
+	err = json.NewDecoder(strings.NewReader(bodyString)).Decode(&out)
+	if err != nil {
+		err = fmt.Errorf("operation %q failed: %s: %w", path, resp.Status, err)
+		if isRetryableStatus(resp.StatusCode) {
+			err = &RetryableError{Err: err}
+		}
+		return nil, err
+	}
+
+	// Check we got 200 OK
+	if resp.StatusCode != http.StatusOK {
+		err = decodeRCError(ctx, path, resp.StatusCode, out)
+		if isRetryableStatus(resp.StatusCode) {
+			err = &RetryableError{Err: err}
+		}
+		return nil, err
+	}
+
+	return
+}
+
+// decodeRCError returns the error described by the json error body of rcd
+func decodeRCError(ctx context.Context, path string, statusCode int, out rc.Params) *RCError {
+
+	rcErr := &RCError{Path: path, Status: statusCode, Message: redactSecrets(ctx, fmt.Sprint(out["error"]))}
+
+	if p, ok := out["path"].(string); ok && p != "" {
+		rcErr.Path = p
+	}
+	if s, ok := out["status"].(float64); ok && s != 0 {
+		rcErr.Status = int(s)
+	}
+
+	return rcErr
+}
+
+// isRetryableStatus returns true for the statuses of overloaded or restarting servers.
+// rcd itself answers 500 for any failing method, after the backend exhausted its own low level retries.
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// embeddedRCClient calls the rc methods registered in this process.
+// Only the rclone packages linked into the binary provide methods, e.g. backends and mount types.
+type embeddedRCClient struct{}
+
+func (c *embeddedRCClient) Call(ctx context.Context, path string, in rc.Params) (rc.Params, error) {
+
+	call := rc.Calls.Get(path)
+	if call == nil || call.NeedsRequest || call.NeedsResponse {
+		return nil, &RCError{Path: path, Status: http.StatusNotFound, Message: fmt.Sprintf("couldn't find method %q", path)}
+	}
+
+	// round trip the parameters through json, so methods see the same values as over http
+	in, err := jsonCopy(in)
+	if err != nil {
+		return nil, err
+	}
+
+	// run the call as rcd does, handling "_async", "_config" and "_filter"
+	_, out, err := jobs.NewJob(ctx, call.Fn, in)
+	if err != nil {
+		// rc.Error picks the status rcd would answer with
+		_, statusCode := rc.Error(path, in, err, http.StatusInternalServerError)
+		return nil, &RCError{Path: path, Status: statusCode, Message: redactSecrets(ctx, err.Error())}
+	}
+
+	return jsonCopy(out)
+}
+
+func jsonCopy(in rc.Params) (rc.Params, error) {
+
+	out := rc.Params{}
+	if in == nil {
+		return out, nil
+	}
+
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,220 @@
+package csirclone
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+// DefaultReconcileInterval is how often mounts are checked when no interval is configured
+const DefaultReconcileInterval = time.Minute
+
+// RunReconciler restores broken mounts on startup, then every interval, until stop is closed.
+func (ns *NodeServer) RunReconciler(interval time.Duration, stop <-chan struct{}) {
+
+	if interval <= 0 {
+		interval = DefaultReconcileInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := ns.Reconcile(ctx); err != nil {
+			klog.Errorf("error reconciling mounts: %s", err)
+		}
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile compares the mounts recorded in the state with those rcd is serving,
+// and remounts those that are missing or broken, along with their bind mounts.
+// This happens when rcd restarts, leaving "transport endpoint is not connected" mounts behind.
+func (ns *NodeServer) Reconcile(ctx context.Context) error {
+
+	mounts, err := ns.state.List()
+	if err != nil {
+		return fmt.Errorf("error listing state: %w", err)
+	}
+	if len(mounts) == 0 {
+		return nil
+	}
+
+	mountPoints, err := ns.driver.ListMounts(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing rcd mounts: %w", err)
+	}
+
+	served := make(map[string]bool, len(mountPoints))
+	for _, mountPoint := range mountPoints {
+		served[mountPoint] = true
+	}
+
+	for _, m := range mounts {
+		if err := ns.reconcileMount(ctx, m, served[m.MountPoint]); err != nil {
+			klog.Errorf("error reconciling mount of %s at %s: %s", m.VolumeID, m.MountPoint, err)
+		}
+	}
+
+	return nil
+}
+
+func (ns *NodeServer) reconcileMount(ctx context.Context, m *Mount, served bool) error {
+
+	// leave volumes alone while an operation is in progress
+	if !ns.vl.TryAcquire(m.VolumeID) {
+		return nil
+	}
+	defer ns.vl.Release(m.VolumeID)
+
+	if ns.collectGarbage(m, served) {
+		return nil
+	}
+
+	// remember the quota verdict of the previous run, for the volume to be staged read-only again
+	if m.QuotaExceeded {
+		ns.overQuota.Store(m.VolumeID, struct{}{})
+	}
+
+	if !served || !ns.isHealthyMount(m.MountPoint) {
+		if err := ns.remount(ctx, m, served); err != nil {
+			return err
+		}
+		err := ns.state.Update(m.VolumeID, func(stored *Mount) {
+			stored.QuotaReadOnly = m.QuotaReadOnly
+		})
+		if err != nil {
+			klog.Errorf("error saving state of %s: %s", m.VolumeID, err)
+		}
+	}
+
+	for _, targetPath := range m.TargetPaths {
+		if err := ns.rebind(m, targetPath); err != nil {
+			klog.Errorf("error reconciling bind mount of %s at %s: %s", m.VolumeID, targetPath, err)
+		}
+	}
+
+	return nil
+}
+
+func (ns *NodeServer) remount(ctx context.Context, m *Mount, served bool) error {
+
+	if m.Secrets {
+		secrets, ok := ns.secrets.Load(m.VolumeID)
+		if !ok {
+			return errors.New("mount uses CSI secrets, which are lost on restart, the volume must be staged again")
+		}
+		ctx = WithSecrets(ctx, secrets.(map[string]string))
+	}
+
+	klog.Infof("Remounting %s at %s", m.VolumeID, m.MountPoint)
+
+	if served {
+		if err := ns.driver.UnmountVolume(ctx, m.MountPoint); err != nil && !errors.Is(err, ErrMountNotFound) {
+			return err
+		}
+	}
+
+	if err := ns.forceUnmount(m.MountPoint); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.MountPoint, 0770); err != nil {
+		return fmt.Errorf("error making mount point: %w", err)
+	}
+
+	return ns.driver.MountVolume(ctx, m)
+}
+
+// collectGarbage forgets the paths that disappeared without being unpublished or unstaged,
+// e.g. when the driver was down while kubelet cleaned up after a pod.
+// It returns true when the whole mount was forgotten.
+func (ns *NodeServer) collectGarbage(m *Mount, served bool) bool {
+
+	if !served && !pathExists(m.MountPoint) {
+		klog.Infof("Forgetting mount of %s at %s, which no longer exists", m.VolumeID, m.MountPoint)
+		if err := ns.state.Delete(m.VolumeID); err != nil {
+			klog.Errorf("error deleting state of %s: %s", m.VolumeID, err)
+		}
+		ns.secrets.Delete(m.VolumeID)
+		return true
+	}
+
+	var gone []string
+	for _, targetPath := range m.TargetPaths {
+		if !pathExists(targetPath) {
+			gone = append(gone, targetPath)
+		}
+	}
+	if len(gone) == 0 {
+		return false
+	}
+
+	for _, targetPath := range gone {
+		klog.Infof("Forgetting bind mount of %s at %s, which no longer exists", m.VolumeID, targetPath)
+		m.RemoveTargetPath(targetPath)
+	}
+	err := ns.state.Update(m.VolumeID, func(stored *Mount) {
+		for _, targetPath := range gone {
+			stored.RemoveTargetPath(targetPath)
+		}
+	})
+	if err != nil {
+		klog.Errorf("error saving state of %s: %s", m.VolumeID, err)
+	}
+
+	return false
+}
+
+// rebind bind mounts the staging path again at a target path,
+// since bind mounts of a broken mount stay broken after it is remounted.
+func (ns *NodeServer) rebind(m *Mount, targetPath string) error {
+
+	if ns.isHealthyMount(targetPath) {
+		return nil
+	}
+
+	lockKey := fmt.Sprintf("%s-%s", m.VolumeID, targetPath)
+	if !ns.vl.TryAcquire(lockKey) {
+		return nil
+	}
+	defer ns.vl.Release(lockKey)
+
+	klog.Infof("Rebinding %s at %s", m.VolumeID, targetPath)
+
+	if err := ns.forceUnmount(targetPath); err != nil {
+		return err
+	}
+
+	options := []string{"bind"}
+	if m.IsReadOnlyTargetPath(targetPath) {
+		options = append(options, "ro")
+	}
+
+	return ns.mounter.Mount(m.MountPoint, targetPath, "", options)
+}
+
+// isHealthyMount returns false when path is not a mount, or a broken one
+func (ns *NodeServer) isHealthyMount(path string) bool {
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(path)
+	return err == nil && !notMnt
+}
+
+// pathExists returns false only when path is known not to exist,
+// a broken mount still exists
+func pathExists(path string) bool {
+	_, err := os.Lstat(path)
+	return !errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,134 @@
+package csirclone
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rclone/rclone/fs/rc"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultRCRetries is how many times failed rc calls are retried when no count is configured
+	DefaultRCRetries = 3
+	// DefaultRCRetryBackoff is the delay before the first retry, doubled on every retry
+	DefaultRCRetryBackoff = 500 * time.Millisecond
+	// DefaultRCTimeout limits each attempt of an rc call
+	DefaultRCTimeout = 2 * time.Minute
+
+	rcRetryJitter = 0.2
+	rcRetryCap    = 30 * time.Second
+)
+
+// idempotentPaths are the rc methods that can be called again after an attempt that may have reached rcd.
+// Moves, purges and mounts are left out, since a lost response would turn a success into a failure.
+var idempotentPaths = map[string]bool{
+	"config/create":       true,
+	"mount/listmounts":    true,
+	"operations/about":    true,
+	"operations/copyfile": true,
+	"operations/list":     true,
+	"operations/mkdir":    true,
+	"operations/size":     true,
+	"operations/stat":     true,
+	"job/status":          true,
+	"options/info":        true,
+	"sync/copy":           true,
+	"vfs/stats":           true,
+}
+
+// longRunningPaths are the rc methods that walk or transfer whole volumes,
+// which are only limited by the deadline of the request, unless started as "_async" jobs.
+// Unmounts are included, since they wait for the vfs cache to be written back.
+var longRunningPaths = map[string]bool{
+	"mount/unmount":    true,
+	"operations/purge": true,
+	"operations/size":  true,
+	"sync/copy":        true,
+}
+
+// RetryableError is a failed rc call that may succeed if attempted again,
+// e.g. when rcd is restarting or behind an overloaded proxy.
+type RetryableError struct {
+	Err error
+	// NotSent is set when the call never reached rcd, so any method can be retried safely
+	NotSent bool
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable returns true when err may go away by calling path again with in.
+// Calls starting an "_async" job are only retried when they never reached rcd,
+// since they would start a second job otherwise.
+func IsRetryable(path string, in rc.Params, err error) bool {
+
+	var retryable *RetryableError
+	if !errors.As(err, &retryable) {
+		return false
+	}
+
+	async, _ := in["_async"].(bool)
+
+	return retryable.NotSent || (idempotentPaths[path] && !async)
+}
+
+// RC calls an rc method of rclone, through rcd or in-process depending on the RcdMode.
+// Each attempt is limited by the RCTimeout, unless the method is long-running,
+// and retryable failures are attempted again up to RCRetries times, with exponential backoff and jitter.
+func (d *Driver) RC(ctx context.Context, path string, in rc.Params) (out rc.Params, err error) {
+
+	backoff := wait.Backoff{
+		Duration: d.RCRetryBackoff,
+		Factor:   2,
+		Jitter:   rcRetryJitter,
+		Steps:    d.RCRetries,
+		Cap:      rcRetryCap,
+	}
+
+	for attempt := 0; ; attempt++ {
+
+		out, err = d.call(ctx, path, in)
+		if err == nil || !IsRetryable(path, in, err) || backoff.Steps <= 0 || ctx.Err() != nil {
+			return out, err
+		}
+
+		delay := backoff.Step()
+		klog.V(2).Infof("rc call %q failed, attempt %d, retrying in %s: %s", path, attempt+1, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return out, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// call makes a single attempt, limited by the RCTimeout unless the method is long-running
+func (d *Driver) call(ctx context.Context, path string, in rc.Params) (rc.Params, error) {
+
+	async, _ := in["_async"].(bool)
+
+	if d.RCTimeout <= 0 || (longRunningPaths[path] && !async) {
+		return d.Client.Call(ctx, path, in)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, d.RCTimeout)
+	defer cancel()
+
+	out, err := d.Client.Call(attemptCtx, path, in)
+
+	// the attempt timed out, but the caller is still waiting
+	if err != nil && attemptCtx.Err() != nil && ctx.Err() == nil {
+		err = &RetryableError{Err: err}
+	}
+
+	return out, err
+}
@@ -0,0 +1,162 @@
+package csirclone
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/rclone/rclone/fs"
+	"golang.org/x/net/context"
+)
+
+// SecretType is the secret key selecting the backend type of an on-the-fly remote.
+// Without it, the remaining keys override the options of the configured remote.
+const SecretType = "type"
+
+type secretsKey struct{}
+
+// WithSecrets returns a context carrying the CSI secrets of a request.
+// Remotes used while serving the request are configured from these secrets,
+// without them ever being written to the rclone config.
+func WithSecrets(ctx context.Context, secrets map[string]string) context.Context {
+	if len(secrets) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, secretsKey{}, secrets)
+}
+
+// withoutSecrets returns a context without the CSI secrets of a request,
+// for calls to the driver remote on behalf of a volume on another remote.
+func withoutSecrets(ctx context.Context) context.Context {
+	if len(secretsFromContext(ctx)) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, secretsKey{}, map[string]string(nil))
+}
+
+func secretsFromContext(ctx context.Context) map[string]string {
+	secrets, _ := ctx.Value(secretsKey{}).(map[string]string)
+	return secrets
+}
+
+// remoteFs returns the fs string to pass to rcd for the remote.
+// When the request carries secrets, a connection string remote is built from them,
+// e.g. "name:path" becomes ":s3,access_key_id=...:path" or "name,access_key_id=...:path",
+// and ":s3,region=eu:bucket" becomes ":s3,region=eu,access_key_id=...:bucket".
+func remoteFs(ctx context.Context, remote string) string {
+
+	secrets := secretsFromContext(ctx)
+	if len(secrets) == 0 {
+		return remote
+	}
+
+	spec, path, found := cutRemote(remote)
+	if !found {
+		// local paths are not remotes
+		return remote
+	}
+
+	name, params, _ := strings.Cut(spec, ",")
+	if backend := secrets[SecretType]; backend != "" {
+		name = ":" + backend
+	}
+
+	keys := make([]string, 0, len(secrets))
+	for k := range secrets {
+		if k != SecretType {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	if params != "" {
+		b.WriteString(",")
+		b.WriteString(params)
+	}
+	for _, k := range keys {
+		b.WriteString(",")
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(strings.ReplaceAll(secrets[k], `"`, `""`))
+		b.WriteString(`"`)
+	}
+	b.WriteString(":")
+	b.WriteString(path)
+
+	return b.String()
+}
+
+// cutRemote splits a remote into its name, with any connection string parameters, and its path.
+// The name of on-the-fly remotes starts with ":", e.g. ":s3,region=eu" for ":s3,region=eu:bucket",
+// and quoted parameter values may contain ":". Local paths are not found.
+func cutRemote(remote string) (spec, path string, found bool) {
+
+	if strings.HasPrefix(remote, "/") {
+		return remote, "", false
+	}
+
+	quoted := false
+	for i := 0; i < len(remote); i++ {
+		switch {
+		case remote[i] == '"':
+			// an escaped quote "" toggles twice
+			quoted = !quoted
+		case remote[i] == ':' && !quoted && i > 0:
+			return remote[:i], remote[i+1:], true
+		}
+	}
+
+	return remote, "", false
+}
+
+// redactSecrets replaces the sensitive secret values of the request found in s.
+// rclone includes the fs string in many errors, which would otherwise leak into logs.
+// Values of options that aren't sensitive, like a region, are kept to help debugging.
+func redactSecrets(ctx context.Context, s string) string {
+
+	secrets := secretsFromContext(ctx)
+
+	for k, v := range secrets {
+		if k == SecretType || v == "" || !isSensitive(secrets[SecretType], k) {
+			continue
+		}
+		// the quoted form is used in connection strings
+		s = strings.ReplaceAll(s, strings.ReplaceAll(v, `"`, `""`), "***")
+		s = strings.ReplaceAll(s, v, "***")
+	}
+
+	return s
+}
+
+// isSensitive returns false for the options that rclone doesn't consider sensitive,
+// for the backend if known, otherwise for every backend declaring the option.
+// Options unknown to rclone are sensitive, as they could be anything.
+func isSensitive(backend, key string) bool {
+
+	key = strings.ReplaceAll(strings.ToLower(key), "-", "_")
+
+	var backends []*fs.RegInfo
+	if backend != "" {
+		if info, err := fs.Find(backend); err == nil {
+			backends = []*fs.RegInfo{info}
+		}
+	} else {
+		backends = fs.Registry
+	}
+
+	known := false
+	for _, info := range backends {
+		for _, opt := range info.Options {
+			if opt.Name != key {
+				continue
+			}
+			if opt.IsPassword || opt.Sensitive {
+				return true
+			}
+			known = true
+		}
+	}
+
+	return !known
+}
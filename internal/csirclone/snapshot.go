@@ -0,0 +1,84 @@
+package csirclone
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"storj.io/common/base58"
+)
+
+var (
+	SnapshotsDirname         = ".csi-snapshots"
+	SnapshotMetadataFilename = ".csi-snapshot"
+)
+
+type Snapshot struct {
+	Remote         string    `json:"remote"`
+	Name           string    `json:"name"`
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	Size           int64     `json:"size"`
+	CreationTime   time.Time `json:"creationTime"`
+	ID             string    `json:"id"`
+}
+
+func NewSnapshot(remote, name, sourceVolumeID string, size int64) *Snapshot {
+
+	hasher := sha1.New()
+	hasher.Write([]byte(name))
+
+	sum := base58.Encode(hasher.Sum(nil))
+
+	return &Snapshot{
+		Remote:         remote,
+		Name:           name,
+		SourceVolumeID: sourceVolumeID,
+		Size:           size,
+		CreationTime:   time.Now().UTC(),
+		ID:             sum,
+	}
+}
+
+func NewSnapshotFromJSON(metadata []byte) (*Snapshot, error) {
+
+	s := &Snapshot{}
+
+	err := json.Unmarshal(metadata, s)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling json: %w", err)
+	}
+
+	return s, nil
+}
+
+// Path returns the location of the snapshot contents, relative to the remote.
+func (s *Snapshot) Path() string {
+	return SnapshotsDirname + "/" + s.ID
+}
+
+func (s *Snapshot) IsConflict(new *Snapshot) error {
+
+	if s.ID != new.ID {
+		return ErrMetaWrongID
+	}
+
+	if s.SourceVolumeID != new.SourceVolumeID {
+		return ErrMetaWrongSource
+	}
+
+	return nil
+}
+
+func (s *Snapshot) Marshal(indent bool) ([]byte, error) {
+	switch indent {
+	case true:
+		return json.MarshalIndent(s, "", "\t")
+	default:
+		return json.Marshal(s)
+	}
+}
+
+func (s *Snapshot) Unmarshal(b []byte) error {
+	return json.Unmarshal(b, s)
+}
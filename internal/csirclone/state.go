@@ -0,0 +1,255 @@
+package csirclone
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"storj.io/common/base58"
+)
+
+// Mount describes an rcd mount of a volume on this node, and the target paths it is published to.
+type Mount struct {
+	VolumeID   string `json:"volumeId"`
+	MountPoint string `json:"mountPoint"`
+	Fs         string `json:"fs"`
+	MountType  string `json:"mountType,omitempty"`
+	MountOpt   string `json:"mountOpt,omitempty"`
+	VfsOpt     string `json:"vfsOpt,omitempty"`
+
+	// Ephemeral is set for inline volumes, mounted straight at their target path
+	Ephemeral bool `json:"ephemeral,omitempty"`
+
+	// ReadOnly mounts the vfs read-only
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// Secrets is set when the volume was staged with CSI secrets, which are never persisted
+	Secrets bool `json:"secrets,omitempty"`
+
+	// QuotaExceeded is set while the volume uses more than its capacity
+	QuotaExceeded bool `json:"quotaExceeded,omitempty"`
+	// QuotaReadOnly is set when the vfs was mounted read-only because the quota was exceeded
+	QuotaReadOnly bool `json:"quotaReadOnly,omitempty"`
+	// Capacity and Used are the last known capacity and size of the volume, when quotas are enabled.
+	// They are only kept on the node, the volume metadata is written by the controller alone.
+	Capacity int64 `json:"capacity,omitempty"`
+	Used     int64 `json:"used,omitempty"`
+
+	// TargetPaths are bind mounts of MountPoint, some of them read-only
+	TargetPaths         []string `json:"targetPaths,omitempty"`
+	ReadOnlyTargetPaths []string `json:"readOnlyTargetPaths,omitempty"`
+}
+
+// IsOverQuota returns true when the volume is known to use more than its capacity.
+func (m *Mount) IsOverQuota() bool {
+	return m.Capacity > 0 && m.Used > m.Capacity
+}
+
+// HasTargetPath returns true when targetPath is a bind mount of the mount.
+func (m *Mount) HasTargetPath(targetPath string) bool {
+	return slices.Contains(m.TargetPaths, targetPath)
+}
+
+// IsReadOnlyTargetPath returns true when targetPath is a read-only bind mount of the mount.
+func (m *Mount) IsReadOnlyTargetPath(targetPath string) bool {
+	return m.ReadOnly || slices.Contains(m.ReadOnlyTargetPaths, targetPath)
+}
+
+// AddTargetPath records a bind mount of the mount, once.
+func (m *Mount) AddTargetPath(targetPath string, readOnly bool) {
+	if !m.HasTargetPath(targetPath) {
+		m.TargetPaths = append(m.TargetPaths, targetPath)
+		sort.Strings(m.TargetPaths)
+	}
+	if readOnly && !slices.Contains(m.ReadOnlyTargetPaths, targetPath) {
+		m.ReadOnlyTargetPaths = append(m.ReadOnlyTargetPaths, targetPath)
+		sort.Strings(m.ReadOnlyTargetPaths)
+	}
+}
+
+// RemoveTargetPath forgets a bind mount of the mount.
+func (m *Mount) RemoveTargetPath(targetPath string) {
+	remove := func(p string) bool {
+		return p == targetPath
+	}
+	m.TargetPaths = slices.DeleteFunc(m.TargetPaths, remove)
+	m.ReadOnlyTargetPaths = slices.DeleteFunc(m.ReadOnlyTargetPaths, remove)
+}
+
+// StateStore keeps the mounts of this node on disk, one json file per volume,
+// so they can be restored when rcd or the driver restart.
+// A nil StateStore stores nothing.
+type StateStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewStateStore(dir string) (*StateStore, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error making state dir: %w", err)
+	}
+
+	return &StateStore{dir: dir}, nil
+}
+
+func (s *StateStore) filename(id string) string {
+	hasher := sha1.New()
+	hasher.Write([]byte(id))
+	return filepath.Join(s.dir, base58.Encode(hasher.Sum(nil))+".json")
+}
+
+// Get returns the mount of the volume, or nil when there is none.
+func (s *StateStore) Get(id string) (*Mount, error) {
+
+	if s == nil {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read(s.filename(id))
+}
+
+// Put records the mount of a volume, replacing any previous one.
+func (s *StateStore) Put(m *Mount) error {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(m)
+}
+
+// Update changes the recorded mount of a volume, if any.
+func (s *StateStore) Update(id string, fn func(m *Mount)) error {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.read(s.filename(id))
+	if err != nil || m == nil {
+		return err
+	}
+
+	fn(m)
+
+	return s.write(m)
+}
+
+// Delete forgets the mount of a volume.
+func (s *StateStore) Delete(id string) error {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.filename(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// List returns every recorded mount, sorted by volume ID.
+func (s *StateStore) List() ([]*Mount, error) {
+
+	if s == nil {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []*Mount{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		m, err := s.read(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			mounts = append(mounts, m)
+		}
+	}
+
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].VolumeID < mounts[j].VolumeID
+	})
+
+	return mounts, nil
+}
+
+func (s *StateStore) read(filename string) (*Mount, error) {
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	m := &Mount{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s: %w", filename, err)
+	}
+
+	return m, nil
+}
+
+// write replaces the file atomically, so a crash never leaves a partial state behind
+func (s *StateStore) write(m *Mount) error {
+
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.filename(m.VolumeID))
+}
@@ -12,11 +12,35 @@ import (
 
 var MetadataFilename = ".csi-metadata"
 
+// RemotesFilename lists the remotes holding volumes besides the driver remote, at the root of the driver remote
+var RemotesFilename = ".csi-remotes"
+
+// Parameters accepted from the StorageClass
+const (
+	// ParameterRemote selects the rclone remote, overriding the driver remote
+	ParameterRemote = "remote"
+	// ParameterPath selects a sub-path of the remote
+	ParameterPath = "path"
+	// ParameterMountOpt and ParameterVfsOpt override mount and vfs options of the driver,
+	// either all at once as json, or one by one with the option name as suffix, e.g. "vfsOpt.CacheMode"
+	ParameterMountOpt = "mountOpt"
+	ParameterVfsOpt   = "vfsOpt"
+	// ParameterMountType overrides the mount type of the driver, e.g. "cmount"
+	ParameterMountType = "mountType"
+
+	// ContextEphemeral is set by kubelet in the volume context of inline volumes
+	ContextEphemeral = "csi.storage.k8s.io/ephemeral"
+)
+
 type Volume struct {
 	Remote   string `json:"remote"`
 	Name     string `json:"name"`
 	Capacity int64  `json:"capacity"`
 	ID       string `json:"id"`
+
+	// MountOpt and VfsOpt are the options overridden by the volume parameters
+	MountOpt map[string]interface{} `json:"mountOpt,omitempty"`
+	VfsOpt   map[string]interface{} `json:"vfsOpt,omitempty"`
 }
 
 func NewVolume(remote, name string, capacity int64) *Volume {
@@ -0,0 +1,74 @@
+package kclient
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// WatchSecret calls handler with the secret every time it is added or updated,
+// until ctx is done. Updates that don't change the secret are skipped.
+func (c *Client) WatchSecret(ctx context.Context, name string, handler func(*corev1.Secret)) error {
+	namespace, _, err := c.Config.Namespace()
+	if err != nil {
+		return fmt.Errorf("error getting current namespace: %w", err)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		c.Set,
+		0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opt *metav1.ListOptions) {
+			opt.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+
+	informer := factory.Core().V1().Secrets().Informer()
+
+	_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				handler(secret)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSecret, ok := oldObj.(*corev1.Secret)
+			if !ok {
+				return
+			}
+			newSecret, ok := newObj.(*corev1.Secret)
+			if !ok || oldSecret.ResourceVersion == newSecret.ResourceVersion {
+				return
+			}
+			handler(newSecret)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error adding secret handler: %w", err)
+	}
+
+	factory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("error syncing secret '%s'", name)
+	}
+
+	return nil
+}
+
+// NewEventRecorder returns a recorder emitting events as component.
+func (c *Client) NewEventRecorder(component string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: c.Set.CoreV1().Events(""),
+	})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component})
+}
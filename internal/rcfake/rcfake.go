@@ -0,0 +1,730 @@
+// Package rcfake provides an in-memory rcd, to test the driver without rclone.
+//
+// Remotes ("name:path") are kept in memory, while local paths are read and written on disk,
+// so that files can be copied between the driver and the fake.
+// Mounts are only recorded, nothing is mounted.
+package rcfake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cornfeedhobo/csi-driver-rclone/internal/csirclone"
+	"github.com/rclone/rclone/fs/rc"
+)
+
+// errors answered with a 404 status by rcd
+var (
+	errObjectNotFound = errors.New("object not found")
+	errDirNotFound    = errors.New("directory not found")
+)
+
+// Mount is a mount recorded by mount/mount
+type Mount struct {
+	Fs         string
+	MountPoint string
+	MountType  string
+	MountOpt   string
+	VfsOpt     string
+}
+
+// RC implements the rc methods used by the driver.
+// The zero value is not usable, see New.
+type RC struct {
+	mu sync.Mutex
+
+	remotes  map[string]bool
+	files    map[string][]byte
+	dirs     map[string]bool
+	mounts   map[string]*Mount
+	failures map[string][]error
+	calls    []string
+
+	// options is answered by options/info, which is not found when nil
+	options rc.Params
+
+	jobs     []*job
+	holdJobs bool
+}
+
+// job is an "_async" call, run immediately unless jobs are held
+type job struct {
+	run      func() (rc.Params, error)
+	finished bool
+	err      error
+}
+
+// New returns a fake rcd with the given remotes configured, e.g. "unittest".
+func New(remotes ...string) *RC {
+
+	f := &RC{
+		remotes:  map[string]bool{},
+		files:    map[string][]byte{},
+		dirs:     map[string]bool{},
+		mounts:   map[string]*Mount{},
+		failures: map[string][]error{},
+	}
+
+	for _, name := range remotes {
+		f.remotes[name] = true
+	}
+
+	return f
+}
+
+// Fail makes the next calls of the method at path fail with err, one call per error.
+// A nil err makes every following call fail, until Reset.
+func (f *RC) Fail(path string, errs ...error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(errs) == 0 {
+		errs = []error{nil}
+	}
+
+	f.failures[path] = append(f.failures[path], errs...)
+}
+
+// Reset clears the failures injected with Fail, and finishes the held jobs.
+func (f *RC) Reset() {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = map[string][]error{}
+	f.releaseJobs()
+}
+
+// SetOptions makes options/info answer options, as decoded from the json of rcd.
+// rcd versions without options/info are faked by default.
+func (f *RC) SetOptions(options rc.Params) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.options = options
+}
+
+// HoldJobs keeps the "_async" jobs started from now on running, until ReleaseJobs.
+func (f *RC) HoldJobs() {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.holdJobs = true
+}
+
+// ReleaseJobs finishes the held jobs, and runs the following ones immediately.
+func (f *RC) ReleaseJobs() {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.releaseJobs()
+}
+
+func (f *RC) releaseJobs() {
+
+	f.holdJobs = false
+	for _, j := range f.jobs {
+		if !j.finished {
+			f.finishJob(j)
+		}
+	}
+}
+
+func (f *RC) finishJob(j *job) {
+	_, j.err = j.run()
+	j.finished = true
+}
+
+// Calls returns the paths of the methods called so far, in order.
+func (f *RC) Calls() []string {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.calls...)
+}
+
+// Mounts returns the recorded mounts, sorted by mount point.
+func (f *RC) Mounts() []Mount {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mounts := make([]Mount, 0, len(f.mounts))
+	for _, m := range f.mounts {
+		mounts = append(mounts, *m)
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].MountPoint < mounts[j].MountPoint
+	})
+
+	return mounts
+}
+
+// ReadFile returns the contents of a file of a remote, e.g. "unittest:dir/file".
+func (f *RC) ReadFile(name string) ([]byte, bool) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, ok := f.files[name]
+	return b, ok
+}
+
+// WriteFile creates a file on a remote, e.g. "unittest:dir/file", with its parent directories.
+func (f *RC) WriteFile(name string, b []byte) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.putFile(name, b)
+}
+
+// Call implements csirclone.RCClient.
+func (f *RC) Call(ctx context.Context, method string, in rc.Params) (rc.Params, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, method)
+
+	if errs := f.failures[method]; len(errs) > 0 {
+		err := errs[0]
+		if err == nil {
+			return nil, failed(method, errors.New("injected failure"))
+		}
+		f.failures[method] = errs[1:]
+		return nil, failed(method, err)
+	}
+
+	handlers := map[string]func(rc.Params) (rc.Params, error){
+		"config/create":       f.configCreate,
+		"job/status":          f.jobStatus,
+		"operations/about":    f.about,
+		"operations/copyfile": f.copyFile,
+		"operations/list":     f.list,
+		"operations/mkdir":    f.mkdir,
+		"operations/movefile": f.moveFile,
+		"operations/purge":    f.purge,
+		"operations/size":     f.size,
+		"operations/stat":     f.stat,
+		"sync/copy":           f.syncCopy,
+		"mount/listmounts":    f.listMounts,
+		"mount/mount":         f.mount,
+		"mount/unmount":       f.unmount,
+		"mount/unmountall":    f.unmountAll,
+		"vfs/stats":           f.vfsStats,
+	}
+	if f.options != nil {
+		handlers["options/info"] = f.optionsInfo
+	}
+	handler, ok := handlers[method]
+	if !ok {
+		return nil, &csirclone.RCError{Path: method, Status: http.StatusNotFound, Message: fmt.Sprintf("couldn't find method %q", method)}
+	}
+
+	if async, _ := in["_async"].(bool); async {
+		return f.startJob(handler, in), nil
+	}
+
+	out, err := handler(in)
+	if err != nil {
+		return nil, failed(method, err)
+	}
+	if out == nil {
+		out = rc.Params{}
+	}
+
+	return out, nil
+}
+
+// failed reports errors as rcd does, keeping injected retryable errors retryable
+func failed(method string, err error) error {
+
+	status := http.StatusInternalServerError
+	if errors.Is(err, errObjectNotFound) || errors.Is(err, errDirNotFound) {
+		status = http.StatusNotFound
+	}
+
+	rcErr := &csirclone.RCError{Path: method, Status: status, Message: err.Error()}
+
+	var retryable *csirclone.RetryableError
+	if errors.As(err, &retryable) {
+		return &csirclone.RetryableError{Err: rcErr, NotSent: retryable.NotSent}
+	}
+
+	return rcErr
+}
+
+// resolve returns the full name of remote within fs, and whether it is on the local disk
+func (f *RC) resolve(fsName, remote string) (string, bool, error) {
+
+	if !strings.Contains(fsName, ":") || strings.HasPrefix(fsName, "/") {
+		return filepath.Join(fsName, remote), true, nil
+	}
+
+	var name, base string
+	if strings.HasPrefix(fsName, ":") {
+		// on-the-fly remotes are always configured, e.g. ":s3,key=value:"
+		name, base, _ = strings.Cut(fsName[1:], ":")
+		name, _, _ = strings.Cut(name, ",")
+		name = ":" + name
+	} else {
+		name, base, _ = strings.Cut(fsName, ":")
+		if !f.remotes[name] {
+			return "", false, errors.New("didn't find section in config file")
+		}
+	}
+
+	p := strings.Trim(path.Join(base, remote), "/")
+	if p == "." {
+		p = ""
+	}
+
+	return name + ":" + p, false, nil
+}
+
+func (f *RC) putFile(name string, b []byte) {
+	f.files[name] = append([]byte(nil), b...)
+	f.putDir(parent(name))
+}
+
+func (f *RC) putDir(name string) {
+	for !isRoot(name) {
+		f.dirs[name] = true
+		name = parent(name)
+	}
+}
+
+func (f *RC) isDir(name string) bool {
+	return isRoot(name) || f.dirs[name]
+}
+
+func parent(name string) string {
+	remote, p, _ := strings.Cut(name, ":")
+	dir := path.Dir(p)
+	if dir == "." {
+		dir = ""
+	}
+	return remote + ":" + dir
+}
+
+// base returns the last element of name, which may be at the root of its remote, e.g. "remote:dir"
+func base(name string) string {
+	_, p, _ := strings.Cut(name, ":")
+	return path.Base(p)
+}
+
+func isRoot(name string) bool {
+	return strings.HasSuffix(name, ":")
+}
+
+func (f *RC) configCreate(in rc.Params) (rc.Params, error) {
+
+	name, err := in.GetString("name")
+	if err != nil {
+		return nil, err
+	}
+	f.remotes[name] = true
+
+	return nil, nil
+}
+
+func (f *RC) about(in rc.Params) (rc.Params, error) {
+
+	name, _, err := f.fsRemote(in, "fs", "")
+	if err != nil {
+		return nil, err
+	}
+	if !f.isDir(name) {
+		return nil, errDirNotFound
+	}
+
+	return nil, errors.New("doesn't support about")
+}
+
+func (f *RC) optionsInfo(in rc.Params) (rc.Params, error) {
+	return f.options, nil
+}
+
+func (f *RC) stat(in rc.Params) (rc.Params, error) {
+
+	name, local, err := f.fsRemote(in, "fs", "remote")
+	if err != nil {
+		return nil, err
+	}
+
+	opt := struct {
+		DirsOnly  bool `json:"dirsOnly"`
+		FilesOnly bool `json:"filesOnly"`
+	}{}
+	if _, ok := in["opt"]; ok {
+		if err := in.GetStruct("opt", &opt); err != nil {
+			return nil, err
+		}
+	}
+
+	var item rc.Params
+	if local {
+		if fi, err := os.Stat(name); err == nil {
+			item = rc.Params{"Path": name, "Name": fi.Name(), "IsDir": fi.IsDir(), "Size": fi.Size()}
+		}
+	} else if b, ok := f.files[name]; ok {
+		item = rc.Params{"Path": name, "Name": base(name), "IsDir": false, "Size": int64(len(b))}
+	} else if f.isDir(name) {
+		item = rc.Params{"Path": name, "Name": base(name), "IsDir": true, "Size": int64(-1)}
+	}
+
+	if item != nil && (opt.DirsOnly && !item["IsDir"].(bool) || opt.FilesOnly && item["IsDir"].(bool)) {
+		item = nil
+	}
+
+	return rc.Params{"item": item}, nil
+}
+
+func (f *RC) copyFile(in rc.Params) (rc.Params, error) {
+	return nil, f.transfer(in, false)
+}
+
+func (f *RC) moveFile(in rc.Params) (rc.Params, error) {
+	return nil, f.transfer(in, true)
+}
+
+func (f *RC) transfer(in rc.Params, move bool) error {
+
+	src, srcLocal, err := f.fsRemote(in, "srcFs", "srcRemote")
+	if err != nil {
+		return err
+	}
+	dst, dstLocal, err := f.fsRemote(in, "dstFs", "dstRemote")
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	if srcLocal {
+		if b, err = os.ReadFile(src); err != nil {
+			return errObjectNotFound
+		}
+	} else {
+		var ok bool
+		if b, ok = f.files[src]; !ok {
+			return errObjectNotFound
+		}
+	}
+
+	if dstLocal {
+		if err := os.WriteFile(dst, b, 0600); err != nil {
+			return err
+		}
+	} else {
+		f.putFile(dst, b)
+	}
+
+	if move {
+		if srcLocal {
+			return os.Remove(src)
+		}
+		delete(f.files, src)
+	}
+
+	return nil
+}
+
+func (f *RC) mkdir(in rc.Params) (rc.Params, error) {
+
+	name, local, err := f.fsRemote(in, "fs", "remote")
+	if err != nil {
+		return nil, err
+	}
+	if local {
+		return nil, os.MkdirAll(name, 0700)
+	}
+
+	f.putDir(name)
+
+	return nil, nil
+}
+
+func (f *RC) purge(in rc.Params) (rc.Params, error) {
+
+	name, _, err := f.fsRemote(in, "fs", "remote")
+	if err != nil {
+		return nil, err
+	}
+	if !f.isDir(name) {
+		return nil, errDirNotFound
+	}
+
+	for _, entries := range []map[string]bool{f.dirs, f.fileSet()} {
+		for entry := range entries {
+			if entry == name || within(entry, name) {
+				delete(f.dirs, entry)
+				delete(f.files, entry)
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (f *RC) list(in rc.Params) (rc.Params, error) {
+
+	name, _, err := f.fsRemote(in, "fs", "remote")
+	if err != nil {
+		return nil, err
+	}
+	if !f.isDir(name) {
+		return nil, errDirNotFound
+	}
+
+	opt := struct {
+		DirsOnly  bool `json:"dirsOnly"`
+		FilesOnly bool `json:"filesOnly"`
+	}{}
+	if _, ok := in["opt"]; ok {
+		if err := in.GetStruct("opt", &opt); err != nil {
+			return nil, err
+		}
+	}
+
+	items := []rc.Params{}
+	if !opt.FilesOnly {
+		for dir := range f.dirs {
+			if parent(dir) == name {
+				items = append(items, rc.Params{"Path": dir, "Name": base(dir), "IsDir": true, "Size": int64(-1)})
+			}
+		}
+	}
+	if !opt.DirsOnly {
+		for file, b := range f.files {
+			if parent(file) == name {
+				items = append(items, rc.Params{"Path": file, "Name": base(file), "IsDir": false, "Size": int64(len(b))})
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i]["Name"].(string) < items[j]["Name"].(string)
+	})
+
+	return rc.Params{"list": items}, nil
+}
+
+func (f *RC) size(in rc.Params) (rc.Params, error) {
+
+	name, _, err := f.fsRemote(in, "fs", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var bytes, count int64
+	for file, b := range f.files {
+		if within(file, name) {
+			bytes += int64(len(b))
+			count++
+		}
+	}
+
+	return rc.Params{"bytes": bytes, "count": count}, nil
+}
+
+func (f *RC) syncCopy(in rc.Params) (rc.Params, error) {
+
+	src, _, err := f.fsRemote(in, "srcFs", "")
+	if err != nil {
+		return nil, err
+	}
+	dst, _, err := f.fsRemote(in, "dstFs", "")
+	if err != nil {
+		return nil, err
+	}
+	if !f.isDir(src) {
+		return nil, errDirNotFound
+	}
+
+	var exclude []string
+	if filter, ok := in["_filter"]; ok {
+		var rules struct{ ExcludeRule []string }
+		if err := rc.Reshape(&rules, filter); err != nil {
+			return nil, err
+		}
+		exclude = rules.ExcludeRule
+	}
+
+	f.putDir(dst)
+	for dir := range f.dirs {
+		if within(dir, src) {
+			f.putDir(dst + strings.TrimPrefix(dir, src))
+		}
+	}
+	for file := range f.fileSet() {
+		if !within(file, src) || excluded(strings.TrimPrefix(file, src), exclude) {
+			continue
+		}
+		f.putFile(dst+strings.TrimPrefix(file, src), f.files[file])
+	}
+
+	return nil, nil
+}
+
+// startJob runs the handler as a job, returning its id as rcd does
+func (f *RC) startJob(handler func(rc.Params) (rc.Params, error), in rc.Params) rc.Params {
+
+	in = in.Copy()
+	delete(in, "_async")
+
+	j := &job{run: func() (rc.Params, error) { return handler(in) }}
+	f.jobs = append(f.jobs, j)
+	if !f.holdJobs {
+		f.finishJob(j)
+	}
+
+	// job ids start at 1
+	return rc.Params{"jobid": int64(len(f.jobs))}
+}
+
+func (f *RC) jobStatus(in rc.Params) (rc.Params, error) {
+
+	id, err := in.GetInt64("jobid")
+	if err != nil {
+		return nil, err
+	}
+	if id < 1 || id > int64(len(f.jobs)) {
+		return nil, errors.New("job not found")
+	}
+
+	j := f.jobs[id-1]
+	out := rc.Params{
+		"id":       id,
+		"finished": j.finished,
+		"success":  j.finished && j.err == nil,
+		"error":    "",
+	}
+	if j.err != nil {
+		out["error"] = j.err.Error()
+	}
+
+	return out, nil
+}
+
+func (f *RC) mount(in rc.Params) (rc.Params, error) {
+
+	m := &Mount{}
+	var err error
+	if m.Fs, err = in.GetString("fs"); err != nil {
+		return nil, err
+	}
+	if m.MountPoint, err = in.GetString("mountPoint"); err != nil {
+		return nil, err
+	}
+	m.MountType, _ = in.GetString("mountType")
+	m.MountOpt, _ = in.GetString("mountOpt")
+	m.VfsOpt, _ = in.GetString("vfsOpt")
+
+	if _, ok := f.mounts[m.MountPoint]; ok {
+		return nil, fmt.Errorf("mount point %s already mounted", m.MountPoint)
+	}
+	f.mounts[m.MountPoint] = m
+
+	return nil, nil
+}
+
+func (f *RC) unmount(in rc.Params) (rc.Params, error) {
+
+	mountPoint, err := in.GetString("mountPoint")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.mounts[mountPoint]; !ok {
+		return nil, errors.New("mount not found")
+	}
+	delete(f.mounts, mountPoint)
+
+	return nil, nil
+}
+
+func (f *RC) unmountAll(in rc.Params) (rc.Params, error) {
+	f.mounts = map[string]*Mount{}
+	return nil, nil
+}
+
+func (f *RC) listMounts(in rc.Params) (rc.Params, error) {
+
+	mountPoints := []rc.Params{}
+	for _, m := range f.mounts {
+		mountPoints = append(mountPoints, rc.Params{"Fs": m.Fs, "MountPoint": m.MountPoint})
+	}
+	sort.Slice(mountPoints, func(i, j int) bool {
+		return mountPoints[i]["MountPoint"].(string) < mountPoints[j]["MountPoint"].(string)
+	})
+
+	return rc.Params{"mountPoints": mountPoints}, nil
+}
+
+func (f *RC) vfsStats(in rc.Params) (rc.Params, error) {
+
+	fsName, err := in.GetString("fs")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range f.mounts {
+		if m.Fs == fsName {
+			return rc.Params{"fs": fsName}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no VFS found with name %q", fsName)
+}
+
+// fsRemote resolves the fs and remote parameters of a call, remoteKey is optional
+func (f *RC) fsRemote(in rc.Params, fsKey, remoteKey string) (string, bool, error) {
+
+	fsName, err := in.GetString(fsKey)
+	if err != nil {
+		return "", false, err
+	}
+
+	remote := ""
+	if remoteKey != "" {
+		remote, _ = in.GetString(remoteKey)
+	}
+
+	return f.resolve(fsName, remote)
+}
+
+func (f *RC) fileSet() map[string]bool {
+	set := make(map[string]bool, len(f.files))
+	for file := range f.files {
+		set[file] = true
+	}
+	return set
+}
+
+// within returns true when name is inside dir
+func within(name, dir string) bool {
+	if isRoot(dir) {
+		return strings.HasPrefix(name, dir) && name != dir
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
+
+func excluded(rel string, rules []string) bool {
+	for _, rule := range rules {
+		if rel == rule {
+			return true
+		}
+	}
+	return false
+}